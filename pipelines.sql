@@ -8,29 +8,45 @@ FIELDS TERMINATED BY '\t'
 OPTIONALLY ENCLOSED BY '"'
 LINES TERMINATED BY '\n';
 
+-- the backup only has the kind column, and its compvecs were packed in kind
+-- order, so the dims are assigned by inserting the kinds in that order
+-- this relies on the backup holding every kind in a single file
+DELIMITER //
+CREATE OR REPLACE PROCEDURE loadUniqueKinds(batch QUERY(kind TEXT NOT NULL COLLATE "utf8_bin")) AS
+BEGIN
+    INSERT IGNORE INTO uniquekind (kind) SELECT kind FROM batch ORDER BY kind;
+END //
+DELIMITER ;
+
 CREATE OR REPLACE PIPELINE uniquekind
 AS LOAD DATA LINK aws_s3 'esports-demo-backup/csv/uniquekind/*'
-SKIP DUPLICATE KEY ERRORS
-INTO TABLE uniquekind FORMAT CSV
+INTO PROCEDURE loadUniqueKinds FORMAT CSV
 FIELDS TERMINATED BY '\t'
 OPTIONALLY ENCLOSED BY '"'
 LINES TERMINATED BY '\n';
 
+-- the backup predates the teamID column, and only has 1v1 games in which
+-- players 1 and 2 are on teams 0 and 1
 CREATE OR REPLACE PIPELINE players
 AS LOAD DATA LINK aws_s3 'esports-demo-backup/csv/players/*'
 SKIP DUPLICATE KEY ERRORS
 INTO TABLE players FORMAT CSV
 FIELDS TERMINATED BY '\t'
 OPTIONALLY ENCLOSED BY '"'
-LINES TERMINATED BY '\n';
+LINES TERMINATED BY '\n'
+(gameID, @playerID, regionID, realmID, toonID, name, race, opponentRace, mmr, apm, result)
+SET playerID = @playerID, teamID = @playerID - 1;
 
+-- the backup only has the first few score values, the others get their
+-- defaults
 CREATE OR REPLACE PIPELINE playerstats
 AS LOAD DATA LINK aws_s3 'esports-demo-backup/csv/playerstats/*'
 SKIP DUPLICATE KEY ERRORS
 INTO TABLE playerstats FORMAT CSV
 FIELDS TERMINATED BY '\t'
 OPTIONALLY ENCLOSED BY '"'
-LINES TERMINATED BY '\n';
+LINES TERMINATED BY '\n'
+(gameID, playerID, loopID, foodMade, foodUsed, mineralsCollectionRate, mineralsCurrent, vespeneCollectionRate, vespeneCurrent);
 
 CREATE OR REPLACE PIPELINE buildcomp
 AS LOAD DATA LINK aws_s3 'esports-demo-backup/csv/buildcomp/*'
@@ -40,12 +56,16 @@ FIELDS TERMINATED BY '\t'
 OPTIONALLY ENCLOSED BY '"'
 LINES TERMINATED BY '\n';
 
+-- the backup predates the version column, which is the number of dims the
+-- vector was packed with
 CREATE OR REPLACE PIPELINE compvecs
 AS LOAD DATA LINK aws_s3 'esports-demo-backup/csv/compvecs/*'
 SKIP DUPLICATE KEY ERRORS
 INTO TABLE compvecs FORMAT CSV
 FIELDS TERMINATED BY '\t'
 OPTIONALLY ENCLOSED BY '"'
-LINES TERMINATED BY '\n';
+LINES TERMINATED BY '\n'
+(gameID, playerID, race, opponentRace, loopID, loopLag, @vec)
+SET vec = @vec, version = length(@vec) div 4;
 
 START ALL PIPELINES;
\ No newline at end of file
@@ -19,9 +19,14 @@ CREATE ROWSTORE TABLE games (
     SHARD (gameID)
 );
 
+-- uniquekind assigns each kind a stable position (dim) in every compvec
+-- dims are never reassigned: new kinds are always appended, so a vector
+-- computed before a kind existed is still valid once padded with zeros
 CREATE ROWSTORE REFERENCE TABLE uniquekind (
     kind TEXT NOT NULL COLLATE "utf8_bin",
-    PRIMARY KEY (kind)
+    dim BIGINT AUTO_INCREMENT NOT NULL,
+    PRIMARY KEY (kind),
+    UNIQUE KEY (dim)
 );
 
 CREATE ROWSTORE REFERENCE TABLE kind2icon (
@@ -36,6 +41,39 @@ INTO TABLE kind2icon
 FIELDS TERMINATED BY ','
 LINES TERMINATED BY '\n';
 
+-- kindweights holds per-kind weights used by the weighted similarity metrics
+-- kinds without a weight in a scheme have a weight of 1
+CREATE ROWSTORE REFERENCE TABLE kindweights (
+    scheme TEXT NOT NULL COLLATE "utf8_bin",
+    kind TEXT NOT NULL COLLATE "utf8_bin",
+    weight DOUBLE NOT NULL,
+    PRIMARY KEY (scheme, kind)
+);
+
+-- kindcatalog describes the units, structures and upgrades in
+-- data/kindcatalog.csv, buildTime is in seconds at faster game speed
+CREATE ROWSTORE REFERENCE TABLE kindcatalog (
+    kind TEXT NOT NULL COLLATE "utf8_bin",
+    minerals INT NOT NULL,
+    vespene INT NOT NULL,
+    supply DOUBLE NOT NULL,
+    buildTime DOUBLE NOT NULL,
+    category TEXT NOT NULL COLLATE "utf8_bin",
+    PRIMARY KEY (kind)
+);
+
+LOAD DATA LOCAL INFILE 'data/kindcatalog.csv'
+SKIP DUPLICATE KEY ERRORS
+INTO TABLE kindcatalog
+FIELDS TERMINATED BY ','
+LINES TERMINATED BY '\n'
+IGNORE 1 LINES;
+
+-- value weights turn each dimension of a compvec from a count into the
+-- resources spent on that kind
+REPLACE INTO kindweights (scheme, kind, weight)
+SELECT 'value', kind, pow(minerals + vespene, 2) FROM kindcatalog;
+
 CREATE TABLE players (
     gameID BIGINT NOT NULL,
     playerID INT NOT NULL,
@@ -46,28 +84,72 @@ CREATE TABLE players (
 
     name TEXT NOT NULL,
     race TEXT NOT NULL COLLATE "utf8_bin",
+    -- the race of the opponent in a 1v1, otherwise the sorted races of every
+    -- player on another team separated by commas
     opponentRace TEXT NOT NULL COLLATE "utf8_bin",
 
     mmr DOUBLE NOT NULL,
     apm DOUBLE NOT NULL,
     result TEXT NOT NULL,
 
+    -- players in a free for all are each on their own team
+    -- this column was added after the backup loaded by pipelines.sql was taken
+    teamID INT NOT NULL,
+
     PRIMARY KEY (gameID, playerID),
     SORT KEY (gameID, playerID),
     SHARD (gameID)
 );
 
+-- playerstats holds every scoreValue field of the PlayerStats tracker event,
+-- see src/const.go
 CREATE TABLE playerstats (
     gameID BIGINT NOT NULL,
     playerID INT NOT NULL,
     loopID BIGINT NOT NULL,
 
-	foodMade               INT NOT NULL,
-	foodUsed               INT NOT NULL,
-	mineralsCollectionRate INT NOT NULL,
-	mineralsCurrent        INT NOT NULL,
-	vespeneCollectionRate  INT NOT NULL,
-	vespeneCurrent         INT NOT NULL,
+	foodMade                         INT NOT NULL,
+	foodUsed                         INT NOT NULL,
+	mineralsCollectionRate           INT NOT NULL,
+	mineralsCurrent                  INT NOT NULL,
+	vespeneCollectionRate            INT NOT NULL,
+	vespeneCurrent                   INT NOT NULL,
+
+	-- the columns below were added after the backup loaded by pipelines.sql
+	-- was taken, so they default to 0
+	workersActiveCount               INT NOT NULL DEFAULT 0,
+	mineralsUsedInProgressArmy       INT NOT NULL DEFAULT 0,
+	mineralsUsedInProgressEconomy    INT NOT NULL DEFAULT 0,
+	mineralsUsedInProgressTechnology INT NOT NULL DEFAULT 0,
+	vespeneUsedInProgressArmy        INT NOT NULL DEFAULT 0,
+	vespeneUsedInProgressEconomy     INT NOT NULL DEFAULT 0,
+	vespeneUsedInProgressTechnology  INT NOT NULL DEFAULT 0,
+	mineralsUsedCurrentArmy          INT NOT NULL DEFAULT 0,
+	mineralsUsedCurrentEconomy       INT NOT NULL DEFAULT 0,
+	mineralsUsedCurrentTechnology    INT NOT NULL DEFAULT 0,
+	vespeneUsedCurrentArmy           INT NOT NULL DEFAULT 0,
+	vespeneUsedCurrentEconomy        INT NOT NULL DEFAULT 0,
+	vespeneUsedCurrentTechnology     INT NOT NULL DEFAULT 0,
+	mineralsLostArmy                 INT NOT NULL DEFAULT 0,
+	mineralsLostEconomy              INT NOT NULL DEFAULT 0,
+	mineralsLostTechnology           INT NOT NULL DEFAULT 0,
+	vespeneLostArmy                  INT NOT NULL DEFAULT 0,
+	vespeneLostEconomy               INT NOT NULL DEFAULT 0,
+	vespeneLostTechnology            INT NOT NULL DEFAULT 0,
+	mineralsKilledArmy               INT NOT NULL DEFAULT 0,
+	mineralsKilledEconomy            INT NOT NULL DEFAULT 0,
+	mineralsKilledTechnology         INT NOT NULL DEFAULT 0,
+	vespeneKilledArmy                INT NOT NULL DEFAULT 0,
+	vespeneKilledEconomy             INT NOT NULL DEFAULT 0,
+	vespeneKilledTechnology          INT NOT NULL DEFAULT 0,
+	mineralsUsedActiveForces         INT NOT NULL DEFAULT 0,
+	vespeneUsedActiveForces          INT NOT NULL DEFAULT 0,
+	mineralsFriendlyFireArmy         INT NOT NULL DEFAULT 0,
+	mineralsFriendlyFireEconomy      INT NOT NULL DEFAULT 0,
+	mineralsFriendlyFireTechnology   INT NOT NULL DEFAULT 0,
+	vespeneFriendlyFireArmy          INT NOT NULL DEFAULT 0,
+	vespeneFriendlyFireEconomy       INT NOT NULL DEFAULT 0,
+	vespeneFriendlyFireTechnology    INT NOT NULL DEFAULT 0,
 
     SORT KEY (gameID, loopID),
     SHARD (gameID)
@@ -85,6 +167,122 @@ CREATE TABLE buildcomp (
     SHARD (gameID)
 );
 
+-- gameevents holds the player commands from the game event stream, see
+-- GameEvent in src/models.go for the meaning of each column
+-- abilityLink and abilityCmdIndex are raw ids which depend on the game version
+CREATE TABLE gameevents (
+    gameID BIGINT NOT NULL,
+    playerID INT NOT NULL,
+    loopID BIGINT NOT NULL,
+
+    eventType TEXT NOT NULL COLLATE "utf8_bin",
+
+    abilityLink INT,
+    abilityCmdIndex INT,
+    cmdFlags INT,
+
+    targetX DOUBLE,
+    targetY DOUBLE,
+    targetUnitTag BIGINT,
+    targetUnitType TEXT COLLATE "utf8_bin",
+
+    controlGroup INT,
+    controlGroupAction INT,
+    unitsAdded INT,
+
+    SORT KEY (gameID, playerID, loopID),
+    SHARD (gameID)
+);
+
+-- unitevents records where each unit was born, started construction and died,
+-- x and y are in map cells
+-- the killer columns are only set on died events
+CREATE TABLE unitevents (
+    gameID BIGINT NOT NULL,
+    unitTag BIGINT NOT NULL,
+    loopID BIGINT NOT NULL,
+    playerID INT NOT NULL,
+
+    kind TEXT NOT NULL COLLATE "utf8_bin",
+    eventType TEXT NOT NULL COLLATE "utf8_bin",
+    x INT NOT NULL,
+    y INT NOT NULL,
+
+    killerPlayerID INT,
+    killerUnitTag BIGINT,
+    killerKind TEXT COLLATE "utf8_bin",
+
+    SORT KEY (gameID, loopID),
+    SHARD (gameID)
+);
+
+-- engagements groups the unit deaths in unitevents into fights, with one row
+-- per player who lost or killed a unit in each engagement, see
+-- src/engagements.go
+CREATE TABLE engagements (
+    gameID BIGINT NOT NULL,
+    engagementID INT NOT NULL,
+    playerID INT NOT NULL,
+
+    startLoop BIGINT NOT NULL,
+    endLoop BIGINT NOT NULL,
+    x DOUBLE NOT NULL,
+    y DOUBLE NOT NULL,
+
+    unitsLost INT NOT NULL,
+    unitsKilled INT NOT NULL,
+    mineralsLost INT NOT NULL,
+    vespeneLost INT NOT NULL,
+
+    SORT KEY (gameID, engagementID),
+    SHARD (gameID)
+);
+
+-- the processor loads each game into the staging tables, and publishGame then
+-- moves it into the tables above in a single transaction
+CREATE ROWSTORE TABLE games_staging LIKE games;
+CREATE TABLE players_staging LIKE players;
+CREATE TABLE playerstats_staging LIKE playerstats;
+CREATE TABLE buildcomp_staging LIKE buildcomp;
+CREATE TABLE gameevents_staging LIKE gameevents;
+CREATE TABLE unitevents_staging LIKE unitevents;
+CREATE TABLE engagements_staging LIKE engagements;
+
+-- processorshards tracks each shard of a distributed processor run, a shard
+-- is done once finishedAt is set
+CREATE ROWSTORE REFERENCE TABLE processorshards (
+    run TEXT NOT NULL COLLATE "utf8_bin",
+    shardIndex INT NOT NULL,
+    shardCount INT NOT NULL,
+    host TEXT NOT NULL,
+    startedAt DATETIME NOT NULL,
+    finishedAt DATETIME,
+    PRIMARY KEY (run, shardIndex)
+);
+
+-- postprocessruns ensures the final postprocess of a run only happens once,
+-- the processor claims a run by inserting its row
+CREATE ROWSTORE REFERENCE TABLE postprocessruns (
+    run TEXT NOT NULL COLLATE "utf8_bin",
+    startedAt DATETIME NOT NULL,
+    finishedAt DATETIME,
+    PRIMARY KEY (run)
+);
+
+-- compvecchunks records the chunks of compvecs finished by the processor's
+-- postprocess command, so that it can resume if it is interrupted
+-- plan describes the games and kinds the chunks were computed from, chunks
+-- from a different plan are stale. looplag is -1 for compvecs without a lag.
+CREATE ROWSTORE REFERENCE TABLE compvecchunks (
+    run TEXT NOT NULL COLLATE "utf8_bin",
+    plan TEXT NOT NULL COLLATE "utf8_bin",
+    looplag BIGINT NOT NULL,
+    fromLoop BIGINT NOT NULL,
+    toLoop BIGINT NOT NULL,
+    finishedAt DATETIME NOT NULL,
+    PRIMARY KEY (run, looplag, fromLoop)
+);
+
 CREATE TABLE compvecs (
     gameID BIGINT NOT NULL,
     playerID INT NOT NULL,
@@ -94,6 +292,11 @@ CREATE TABLE compvecs (
     loopID BIGINT NOT NULL,
     loopLag BIGINT,
 
+    -- vec only counts the player's own units, even in team games
+    -- version is the number of kinds in uniquekind when vec was computed
+    -- since dims are append-only, a vector is re-projected onto a newer
+    -- version by padding it with zeros
+    version BIGINT NOT NULL,
     vec LONGBLOB NOT NULL,
 
     SORT KEY (race, opponentRace, loopid) with (columnstore_segment_rows=200000),
@@ -105,7 +308,7 @@ CREATE TABLE compvecs (
 CREATE OR REPLACE FUNCTION compvec_inner(p_minloop BIGINT, p_maxloop BIGINT)
     RETURNS TABLE AS RETURN
         select
-            players.gameid, players.playerid, players.race, players.opponentRace, kind,
+            players.gameid, players.playerid, players.race, players.opponentRace, kinds.kind, kinds.dim,
             ifnull((
                 select sum(num) as num
                 from buildcomp bc
@@ -124,7 +327,7 @@ CREATE OR REPLACE FUNCTION compvec(p_minloop BIGINT, p_maxloop BIGINT)
     RETURNS TABLE AS RETURN
         select 
             gameid, playerid, race, opponentRace,
-            json_array_pack(concat("[",group_concat(num order by kind asc separator ','),"]")) as vec
+            json_array_pack(concat("[",group_concat(num order by dim asc separator ','),"]")) as vec
         from compvec_inner(p_minloop, p_maxloop)
         group by gameid, playerid;
 
@@ -132,7 +335,7 @@ CREATE OR REPLACE FUNCTION compvecByRace(p_minloop BIGINT, p_maxloop BIGINT, p_r
     RETURNS TABLE AS RETURN
         select 
             gameid, playerid, race, opponentRace,
-            json_array_pack(concat("[",group_concat(num order by kind asc separator ','),"]")) as vec
+            json_array_pack(concat("[",group_concat(num order by dim asc separator ','),"]")) as vec
         from compvec_inner(p_minloop, p_maxloop)
         where race = p_race and opponentRace = p_opponentRace
         group by gameid, playerid;
@@ -145,11 +348,13 @@ create or replace function comp(p_gameid bigint, p_playerid int, p_minloop BIGIN
         and loopid between p_minloop and p_maxloop
         group by kind;
 
+-- compare lines up two compositions over the p_lag loops before each loop, or
+-- the whole game up to each loop if p_lag is null
 create or replace function compare(p_gameid bigint, p_playerid int, p_loopid bigint, p_gameid2 bigint, p_playerid2 int, p_loopid2 bigint, p_lag BIGINT)
     returns table as return
         select ifnull(a.kind, b.kind) kind, ifnull(a.num, 0) as player1, ifnull(b.num, 0) as player2
-        from comp(p_gameid, p_playerid, p_loopid-p_lag, p_loopid) a
-        full outer join comp(p_gameid2, p_playerid2, p_loopid2-p_lag, p_loopid2) b
+        from comp(p_gameid, p_playerid, ifnull(p_loopid-p_lag, 0), p_loopid) a
+        full outer join comp(p_gameid2, p_playerid2, ifnull(p_loopid2-p_lag, 0), p_loopid2) b
         on a.kind = b.kind
         order by 1 asc;
 
@@ -189,10 +394,55 @@ RETURNS TABLE AS RETURN
         other.playerid,
         other.loopid,
         other.looplag,
-        EUCLIDEAN_DISTANCE(other.vec, (
+        EUCLIDEAN_DISTANCE(
+            -- vectors computed before new kinds were added are shorter than
+            -- the query vector, pad them with zeros for the missing kinds
+            concat(other.vec, repeat(unhex('00000000'), (length(player.vec) div 4) - other.version)),
+            player.vec
+        ) dist
+    from
+        compvecs as other,
+        (
             select vec from compvec(p_loopid - p_lag, p_loopid)
             where gameid = p_gameid and playerid = p_playerid
-        )) dist
+        ) as player
+    where
+        other.gameid != p_gameid
+        and other.race = p_race
+        and other.opponentRace = p_opponentRace
+        and other.loopid between p_loopid - (p_lag * 2) and p_loopid + (p_lag * 2)
+        -- refuse vectors from a version we can't re-project
+        and other.version <= length(player.vec) div 4
+        and length(other.vec) div 4 = other.version
+    order by
+        dist asc,
+        ABS(p_loopid-other.loopid) asc,
+        other.gameid,
+        other.playerid
+    limit p_limit;
+
+-- similarVecPoints is the same search as similarGamePoints except that the
+-- caller provides the query vector along with the version it was computed at
+CREATE OR REPLACE FUNCTION similarVecPoints(
+    p_gameid        BIGINT,
+    p_race          TEXT NOT NULL COLLATE "utf8_bin",
+    p_opponentRace  TEXT NOT NULL COLLATE "utf8_bin",
+    p_loopid        BIGINT,
+    p_lag           BIGINT,
+    p_limit         INT,
+    p_vec           LONGBLOB NOT NULL,
+    p_version       BIGINT
+)
+RETURNS TABLE AS RETURN
+    select
+        other.gameid,
+        other.playerid,
+        other.loopid,
+        other.looplag,
+        EUCLIDEAN_DISTANCE(
+            concat(other.vec, repeat(unhex('00000000'), p_version - other.version)),
+            p_vec
+        ) dist
     from
         compvecs as other
     where
@@ -200,6 +450,57 @@ RETURNS TABLE AS RETURN
         and other.race = p_race
         and other.opponentRace = p_opponentRace
         and other.loopid between p_loopid - (p_lag * 2) and p_loopid + (p_lag * 2)
+        and other.version <= p_version
+        and length(other.vec) div 4 = other.version
+    order by
+        dist asc,
+        ABS(p_loopid-other.loopid) asc,
+        other.gameid,
+        other.playerid
+    limit p_limit;
+
+-- similarWeightedPoints is similarVecPoints with a choice of metric
+-- p_weights holds the square root of each dimension's weight, and p_vec must
+-- already be multiplied by it
+CREATE OR REPLACE FUNCTION similarWeightedPoints(
+    p_gameid        BIGINT,
+    p_race          TEXT NOT NULL COLLATE "utf8_bin",
+    p_opponentRace  TEXT NOT NULL COLLATE "utf8_bin",
+    p_loopid        BIGINT,
+    p_lag           BIGINT,
+    p_limit         INT,
+    p_vec           LONGBLOB NOT NULL,
+    p_version       BIGINT,
+    p_metric        TEXT NOT NULL,
+    p_weights       LONGBLOB NOT NULL
+)
+RETURNS TABLE AS RETURN
+    select
+        other.gameid,
+        other.playerid,
+        other.loopid,
+        other.looplag,
+        case p_metric
+            -- a zero vector divides by zero, which is null
+            when 'cosine' then ifnull(
+                1 - DOT_PRODUCT(other.vec, p_vec) / sqrt(DOT_PRODUCT(other.vec, other.vec) * DOT_PRODUCT(p_vec, p_vec)),
+                1
+            )
+            else EUCLIDEAN_DISTANCE(other.vec, p_vec)
+        end dist
+    from (
+        select
+            gameid, playerid, loopid, looplag,
+            VECTOR_MUL(concat(vec, repeat(unhex('00000000'), p_version - version)), p_weights) vec
+        from compvecs
+        where
+            gameid != p_gameid
+            and race = p_race
+            and opponentRace = p_opponentRace
+            and loopid between p_loopid - (p_lag * 2) and p_loopid + (p_lag * 2)
+            and version <= p_version
+            and length(vec) div 4 = version
+    ) as other
     order by
         dist asc,
         ABS(p_loopid-other.loopid) asc,
@@ -207,17 +508,37 @@ RETURNS TABLE AS RETURN
         other.playerid
     limit p_limit;
 
+-- tfidfWeights computes the tfidf weight of each kind, where each player in
+-- each game is a document
+-- kinds which every player builds end up with a weight close to 1, and rare
+-- kinds a higher weight
+CREATE OR REPLACE FUNCTION tfidfWeights()
+RETURNS TABLE AS RETURN
+    select docs.kind, ln((1 + total.numdocs) / (1 + count(*))) + 1 as weight
+    from
+        (select distinct gameid, playerid, kind from buildcomp where num > 0) as docs,
+        (select count(*) as numdocs from (select distinct gameid, playerid from buildcomp where num > 0) players) as total
+    group by docs.kind, total.numdocs;
+
 delimiter //
 
-create or replace procedure prepareCompvecsLag(loopInterval INT, maxloop BIGINT, lag BIGINT) AS
+-- prepareCompvecsRange computes the compvecs of every game for one lag at
+-- each loop from fromloop to toloop, the processor's postprocess command runs
+-- many of these at once
+create or replace procedure prepareCompvecsRange(loopInterval INT, fromloop BIGINT, toloop BIGINT, lag BIGINT) AS
 BEGIN
-    FOR curloop IN loopInterval .. maxloop BY loopInterval LOOP
-        REPLACE INTO compvecs (gameid, playerid, race, opponentRace, loopid, looplag, vec)
-        SELECT gameid, playerid, race, opponentRace, curloop, lag, vec
+    FOR curloop IN fromloop .. toloop BY loopInterval LOOP
+        REPLACE INTO compvecs (gameid, playerid, race, opponentRace, loopid, looplag, version, vec)
+        SELECT gameid, playerid, race, opponentRace, curloop, lag, length(vec) div 4, vec
         FROM compvec(IFNULL(curloop-lag, 0), curloop);
     END LOOP;
 END //
 
+create or replace procedure prepareCompvecsLag(loopInterval INT, maxloop BIGINT, lag BIGINT) AS
+BEGIN
+    CALL prepareCompvecsRange(loopInterval, loopInterval, maxloop, lag);
+END //
+
 create or replace procedure prepareCompvecs(loopInterval INT) AS
 DECLARE
     maxlooptbl QUERY(maxloop BIGINT) = select max(loops) from games;
@@ -233,14 +554,24 @@ END //
 
 create or replace procedure prepareUniqueKinds() AS
 BEGIN
-    DELETE from uniquekind;
-    INSERT INTO uniquekind SELECT DISTINCT kind FROM buildcomp;
+    INSERT IGNORE INTO uniquekind (kind) SELECT DISTINCT kind FROM buildcomp ORDER BY kind;
+END //
+
+-- prepareKindWeights stores a snapshot of the tfidf weights in kindweights
+-- the player api computes them on demand with tfidfWeights() instead, so that
+-- they include games loaded since the last postprocess
+create or replace procedure prepareKindWeights() AS
+BEGIN
+    DELETE FROM kindweights WHERE scheme = 'tfidf';
+    INSERT INTO kindweights (scheme, kind, weight)
+    SELECT 'tfidf', kind, weight FROM tfidfWeights();
 END //
 
 create or replace procedure postprocess() AS
 BEGIN
     CALL prepareUniqueKinds();
     CALL prepareCompvecs(80);
+    CALL prepareKindWeights();
 END //
 
 create or replace procedure deleteGame(p_gameid BIGINT) AS
@@ -249,7 +580,57 @@ BEGIN
     DELETE FROM players where gameid = p_gameid;
     DELETE FROM playerstats where gameid = p_gameid;
     DELETE FROM buildcomp where gameid = p_gameid;
+    DELETE FROM gameevents where gameid = p_gameid;
+    DELETE FROM unitevents where gameid = p_gameid;
+    DELETE FROM engagements where gameid = p_gameid;
     DELETE FROM compvecs where gameid = p_gameid;
 END //
 
+create or replace procedure discardStagedGame(p_gameid BIGINT) AS
+BEGIN
+    DELETE FROM games_staging where gameid = p_gameid;
+    DELETE FROM players_staging where gameid = p_gameid;
+    DELETE FROM playerstats_staging where gameid = p_gameid;
+    DELETE FROM buildcomp_staging where gameid = p_gameid;
+    DELETE FROM gameevents_staging where gameid = p_gameid;
+    DELETE FROM unitevents_staging where gameid = p_gameid;
+    DELETE FROM engagements_staging where gameid = p_gameid;
+END //
+
+-- publishGame replaces a game with its staged copy in a single transaction,
+-- so that a game is never partially visible to the player api
+-- unless p_loaded is set the game is left unloaded, the processor then
+-- computes its compvecs from the events it still has in memory and marks it
+-- as loaded once they are written, so the transaction isn't held open while
+-- they are computed. An unloaded game is hidden from the game list and loaded
+-- again by the next run of the processor.
+-- the processor sets p_loaded when it is run with -skip-postprocess, in which
+-- case the compvecs are computed by postprocess() once every game is loaded
+create or replace procedure publishGame(p_gameid BIGINT, p_loaded BOOL) AS
+BEGIN
+    -- kinds are append-only, so registering them outside of the transaction
+    -- leaves every other compvec valid even if the publish fails
+    INSERT IGNORE INTO uniquekind (kind) SELECT DISTINCT kind FROM buildcomp_staging WHERE gameid = p_gameid ORDER BY kind;
+
+    START TRANSACTION;
+    CALL deleteGame(p_gameid);
+    INSERT INTO games SELECT * FROM games_staging WHERE gameid = p_gameid;
+    INSERT INTO players SELECT * FROM players_staging WHERE gameid = p_gameid;
+    INSERT INTO playerstats SELECT * FROM playerstats_staging WHERE gameid = p_gameid;
+    INSERT INTO buildcomp SELECT * FROM buildcomp_staging WHERE gameid = p_gameid;
+    INSERT INTO gameevents SELECT * FROM gameevents_staging WHERE gameid = p_gameid;
+    INSERT INTO unitevents SELECT * FROM unitevents_staging WHERE gameid = p_gameid;
+    INSERT INTO engagements SELECT * FROM engagements_staging WHERE gameid = p_gameid;
+    IF p_loaded THEN
+        UPDATE games SET loaded = true WHERE gameid = p_gameid;
+    END IF;
+    COMMIT;
+
+    CALL discardStagedGame(p_gameid);
+EXCEPTION
+    WHEN OTHERS THEN
+        ROLLBACK;
+        RAISE;
+END //
+
 delimiter ;
\ No newline at end of file
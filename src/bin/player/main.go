@@ -33,31 +33,40 @@ func main() {
 		log.Fatalf("unable to load config files: %v; error: %+v", configPaths, err)
 	}
 
-	var db *src.Singlestore
+	var store src.Store
 	for {
-		db, err = src.NewSinglestore(config.Singlestore)
+		store, err = src.OpenStore(config.Store())
 		if err != nil {
-			log.Printf("unable to connect to SingleStore: %s; retrying...", err)
+			log.Printf("unable to open store: %s; retrying...", err)
 			time.Sleep(time.Second)
 			continue
 		}
 		break
 	}
-	defer db.Close()
+	defer store.Close()
 
 	if config.GinMode == "release" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	router := gin.Default()
+	server := src.NewReplayServer(config, store)
+
+	router := gin.New()
+	// the access log includes the request ID set by the metrics middleware
+	router.Use(src.RequestLogger())
+	// tags each request with an ID and records its latency if metrics are enabled
+	router.Use(server.Metrics.Middleware())
+	// recovers inside the metrics middleware, so panics are counted as 500s
+	router.Use(gin.Recovery())
 	router.Use(cors.New(cors.Config{
 		AllowAllOrigins: true,
 		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		ExposeHeaders:   []string{"X-Request-ID"},
 		MaxAge:          12 * time.Hour,
 	}))
-	router.Use(gzip.Gzip(gzip.DefaultCompression))
+	// Server-Sent Event streams must not be buffered by the gzip writer
+	router.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPathsRegexs([]string{"/stream$"})))
 
-	server := src.NewReplayServer(config, db)
 	server.RegisterRoutes(router)
 
 	router.Run(fmt.Sprintf(":%d", config.Port))
@@ -3,13 +3,14 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -22,8 +23,34 @@ func main() {
 
 	configPaths := src.FlagStringSlice{}
 	flag.Var(&configPaths, "config", "path to the config file; can be provided multiple times, files will be merged in the order provided")
+	shard := src.Shard{}
+	flag.IntVar(&shard.Index, "shard-index", 0, "index of the shard of replays this processor loads, from 0 to shard-count-1")
+	flag.IntVar(&shard.Count, "shard-count", 1, "number of processors the replays are split between")
+	run := flag.String("run", "", "name of a distributed run; ingest records the progress of its shard under this name and postprocess waits for every shard to finish")
+	skipPostprocess := flag.Bool("skip-postprocess", false, "publish games without computing their compvecs, run the postprocess command once every game is loaded")
+	force := flag.Bool("force", false, "postprocess: take over a run whose postprocess was claimed but never finished")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [ingest|watch|retry-failed|postprocess]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  ingest: load every replay in replayDir (default)")
+		fmt.Fprintln(flag.CommandLine.Output(), "  watch: load replays as they are written to replayDir until interrupted")
+		fmt.Fprintln(flag.CommandLine.Output(), "  retry-failed: load only the replays listed in the dead letter file")
+		fmt.Fprintln(flag.CommandLine.Output(), "  postprocess: compute the compvecs and kind weights of every game, once every shard of -run has finished")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	command := flag.Arg(0)
+	if command == "" {
+		command = "ingest"
+	}
+	if command != "ingest" && command != "watch" && command != "retry-failed" && command != "postprocess" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := shard.Validate(); err != nil {
+		log.Fatalf("invalid shard: %s", err)
+	}
+
 	if len(configPaths) == 0 {
 		configPaths.Set("config.toml")
 	}
@@ -35,18 +62,43 @@ func main() {
 	if err != nil {
 		log.Fatalf("unable to load config files: %v; error: %+v", configPaths, err)
 	}
+	if *skipPostprocess {
+		config.SkipPostprocess = true
+	}
+	// every processor holds its own copy of a memory store and overwrites the
+	// file with it, so processors can't share one
+	if config.Backend == src.BackendMemory && (shard.Count > 1 || *run != "") {
+		log.Fatalf("-shard-count and -run require the singlestore backend")
+	}
 
-	var db *src.Singlestore
+	var store src.Store
 	for {
-		db, err = src.NewSinglestore(config.Singlestore)
+		store, err = src.OpenStore(config.Store())
 		if err != nil {
-			log.Printf("unable to connect to SingleStore: %s; retrying...", err)
+			log.Printf("unable to open store: %s; retrying...", err)
 			time.Sleep(time.Second)
 			continue
 		}
 		break
 	}
-	defer db.Close()
+	defer store.Close()
+
+	if command == "postprocess" {
+		if err := postprocess(store, config, *run, *force); err != nil {
+			store.Close()
+			log.Fatalf("postprocess failed: %s", err)
+		}
+		return
+	}
+
+	deadLetterFile := config.DeadLetterFile
+	if deadLetterFile == "" {
+		deadLetterFile = "data/failed_replays.json"
+	}
+	deadLetters, err := src.OpenDeadLetters(deadLetterFile)
+	if err != nil {
+		log.Fatalf("unable to open dead letter file: %s", err)
+	}
 
 	numWorkers := runtime.NumCPU()
 	if config.NumWorkers != 0 {
@@ -57,18 +109,70 @@ func main() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
+	shutdown := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Printf("received shutdown signal: %s", sig)
+		close(shutdown)
+	}()
+
+	stats := src.NewIngestStats(command)
+	if config.Report.MetricsPort != 0 {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", stats.Metrics)
+			addr := fmt.Sprintf(":%d", config.Report.MetricsPort)
+			log.Printf("serving metrics on %s/metrics", addr)
+			log.Printf("metrics server stopped: %s", http.ListenAndServe(addr, mux))
+		}()
+	}
+
+	reportInterval := 10 * time.Second
+	if config.Report.IntervalMs != 0 {
+		reportInterval = time.Duration(config.Report.IntervalMs) * time.Millisecond
+	}
+	stopProgress := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(reportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report := stats.Report()
+				log.Print(report.Progress())
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	if shard.Count > 1 {
+		log.Printf("loading shard %s of the replays", shard)
+	}
+	if config.SkipPostprocess {
+		log.Printf("compvecs will not be computed, run the postprocess command once every game is loaded")
+	}
+	trackShard := *run != "" && command == "ingest"
+	if trackShard {
+		host, _ := os.Hostname()
+		if err := store.StartShard(*run, shard, host); err != nil {
+			log.Fatalf("unable to record the start of shard %s: %s", shard, err)
+		}
+	}
+
 	log.Printf("starting processor with %d workers", numWorkers)
 
 	workQueue := make(chan string)
 	closeChannels := make([]chan struct{}, 0)
 	wg := sync.WaitGroup{}
+	summary := &runSummary{}
 
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
 		closeCh := make(chan struct{})
 		closeChannels = append(closeChannels, closeCh)
 
-		env := src.NewProcessorEnv(i, config, db)
+		env := src.NewProcessorEnv(i, config, store, stats)
 
 		go func() {
 			defer wg.Done()
@@ -76,11 +180,24 @@ func main() {
 			for {
 				select {
 				case file := <-workQueue:
+					if !shard.Owns(src.ReplayGameID(config.ReplayDir, file)) {
+						continue
+					}
+
 					log.Printf("processing file %s", file)
 					time.Sleep(time.Second)
-					err := src.Run(env, file)
+					stats.Seen()
+					attempts, err := src.RunWithRetry(env, file, config.Retry, shutdown)
+					summary.add(file, err)
 					if err != nil {
-						log.Fatalf("error processing file %s: %v", file, err)
+						stats.Failed()
+						log.Printf("error processing file %s after %d attempts: %v", file, attempts, err)
+						err = deadLetters.Record(file, attempts, err)
+					} else {
+						err = deadLetters.Resolve(file)
+					}
+					if err != nil {
+						log.Printf("unable to update dead letter file: %s", err)
 					}
 				case <-closeCh:
 					return
@@ -91,24 +208,65 @@ func main() {
 
 	errShutdown := errors.New("shutdown")
 
-	err = filepath.Walk(config.ReplayDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
+	if command == "watch" {
+		interval := time.Second
+		if config.Watch.IntervalMs != 0 {
+			interval = time.Duration(config.Watch.IntervalMs) * time.Millisecond
 		}
-
-		basename := filepath.Base(path)
-		if !strings.HasSuffix(basename, ".SC2Replay") || strings.HasPrefix(basename, ".") {
-			return nil
+		settle := 5 * time.Second
+		if config.Watch.SettleMs != 0 {
+			settle = time.Duration(config.Watch.SettleMs) * time.Millisecond
 		}
 
-		select {
-		case workQueue <- path:
-		case sig := <-signals:
-			log.Printf("received shutdown signal: %s", sig)
-			return errShutdown
+		log.Printf("watching %s for new replays", config.ReplayDir)
+		watcher := src.NewReplayWatcher(config.ReplayDir, interval, settle)
+		err = watcher.Watch(workQueue, shutdown)
+	} else if command == "retry-failed" {
+		failedFiles := deadLetters.Files()
+		stats.SetTotal(int64(len(failedFiles)))
+		for _, failed := range failedFiles {
+			if _, statErr := os.Stat(failed.Path); statErr != nil {
+				log.Printf("unable to retry %s: %s", failed.Path, statErr)
+				continue
+			}
+
+			select {
+			case workQueue <- failed.Path:
+			case <-shutdown:
+				err = errShutdown
+			}
+			if err != nil {
+				break
+			}
 		}
-		return nil
-	})
+	} else {
+		// count the replays up front so progress can include an ETA
+		go func() {
+			total, err := countReplays(config.ReplayDir, shard)
+			if err != nil {
+				log.Printf("unable to count replays: %s", err)
+				return
+			}
+			stats.SetTotal(total)
+		}()
+
+		err = filepath.Walk(config.ReplayDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+
+			if !src.IsReplayFile(path) {
+				return nil
+			}
+
+			select {
+			case workQueue <- path:
+			case <-shutdown:
+				return errShutdown
+			}
+			return nil
+		})
+	}
 
 	if err != nil && err != errShutdown {
 		log.Fatalf("error while processing %s: %v", config.ReplayDir, err)
@@ -119,13 +277,142 @@ func main() {
 	}
 
 	wg.Wait()
+	close(stopProgress)
 
-	if err == nil {
-		now := time.Now()
-		log.Printf("starting postprocess() at %s", now)
-		if _, err := db.Exec("CALL postprocess()"); err != nil {
-			log.Fatalf("postprocess() failed: %s", err)
+	summary.log(deadLetterFile)
+
+	interrupted := err == errShutdown
+	select {
+	case <-shutdown:
+		interrupted = true
+	default:
+	}
+
+	// an interrupted shard must be run again before the run is complete
+	if trackShard && !interrupted {
+		if err := store.FinishShard(*run, shard); err != nil {
+			log.Printf("unable to record the end of shard %s: %s", shard, err)
+		} else {
+			log.Printf("shard %s of run %s is done", shard, *run)
+		}
+	}
+
+	report := stats.Report()
+	log.Print(report.Progress())
+	log.Printf("time spent in each stage:")
+	report.LogStages()
+
+	reportFile := config.Report.File
+	if reportFile == "" {
+		reportFile = "data/ingest_report.json"
+	}
+	if err := report.WriteFile(reportFile); err != nil {
+		log.Printf("unable to write report: %s", err)
+	} else {
+		log.Printf("wrote report to %s", reportFile)
+	}
+}
+
+func countReplays(dir string, shard src.Shard) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if src.IsReplayFile(path) && shard.Owns(src.ReplayGameID(dir, path)) {
+			total++
+		}
+		return nil
+	})
+	return total, err
+}
+
+// postprocess computes the compvecs and kind weights of every game
+// If run is set, it only proceeds once every shard of the run has finished
+// and no other processor has postprocessed the run.
+func postprocess(store src.Store, config *src.ProcessorConfig, run string, force bool) error {
+	if run != "" {
+		shards, err := store.ListShards(run)
+		if err != nil {
+			return err
+		}
+		if err := src.CheckShardsDone(run, shards); err != nil {
+			return err
+		}
+		if err := store.ClaimPostprocess(run, force); err != nil {
+			return err
+		}
+		log.Printf("all %d shards of run %s are done", len(shards), run)
+	}
+
+	interval := 10 * time.Second
+	if config.Report.IntervalMs != 0 {
+		interval = time.Duration(config.Report.IntervalMs) * time.Millisecond
+	}
+
+	log.Printf("running postprocess")
+	start := time.Now()
+	lastReport := time.Time{}
+	progress := func(done int, total int) {
+		if done != total && time.Since(lastReport) < interval {
+			return
+		}
+		lastReport = time.Now()
+
+		line := fmt.Sprintf("postprocess: %d/%d chunks", done, total)
+		if elapsed := time.Since(start); done > 0 && done < total {
+			eta := time.Duration(float64(elapsed) / float64(done) * float64(total-done))
+			line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+		}
+		log.Print(line)
+	}
+	err := store.Postprocess(run, config.Postprocess, progress)
+
+	if run != "" {
+		if completeErr := store.CompletePostprocess(run, err == nil); completeErr != nil {
+			log.Printf("unable to record the end of the postprocess of run %s: %s", run, completeErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("postprocess finished in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runSummary counts the replays processed by every worker
+type runSummary struct {
+	mu          sync.Mutex
+	processed   int
+	failed      []string
+	quarantined int
+}
+
+func (s *runSummary) add(file string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.processed++
+	if err != nil {
+		s.failed = append(s.failed, fmt.Sprintf("%s: %s", file, err))
+
+		var runErr *src.RunError
+		if errors.As(err, &runErr) && !runErr.Transient() {
+			s.quarantined++
 		}
-		log.Printf("postprocess() finished in %s", time.Since(now))
+	}
+}
+
+func (s *runSummary) log(deadLetterFile string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Printf("processed %d replays, %d failed (%d quarantined)", s.processed, len(s.failed), s.quarantined)
+	for _, failed := range s.failed {
+		log.Printf("  %s", failed)
+	}
+	if len(s.failed) > 0 {
+		log.Printf("failed replays are listed in %s, run `%s retry-failed` to process them again", deadLetterFile, os.Args[0])
 	}
 }
@@ -0,0 +1,108 @@
+package src
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	CategoryWorker    = "worker"
+	CategoryArmy      = "army"
+	CategoryStructure = "structure"
+	CategoryUpgrade   = "upgrade"
+)
+
+// WeightsValue weights each kind by the square of its resource cost
+// Scaling both vectors by the square root of these weights turns a count into
+// the resources spent on a kind, so weighted-euclidean with value weights is
+// the euclidean distance between the value variant of the compvecs.
+const WeightsValue = "value"
+
+// KindInfo describes a kind in the unit catalog, see data/kindcatalog.csv
+// Morphed kinds like BroodLord include the cost of the kind they morph from,
+// since buildcomp replaces one with the other.
+type KindInfo struct {
+	Kind     string  `json:"kind"`
+	Minerals int     `json:"minerals"`
+	Vespene  int     `json:"vespene"`
+	Supply   float64 `json:"supply"`
+	// BuildTime is in seconds at faster game speed
+	BuildTime float64 `json:"buildTime"`
+	Category  string  `json:"category"`
+}
+
+// Value is the total resources spent on a kind
+func (k *KindInfo) Value() int {
+	return k.Minerals + k.Vespene
+}
+
+// ValueWeights returns the value weights for a catalog
+// Kinds which are not in the catalog keep a weight of 1, which is negligible
+// next to the value of any kind which is.
+func ValueWeights(catalog []KindInfo) KindWeights {
+	weights := make(KindWeights, len(catalog))
+	for _, info := range catalog {
+		weights[info.Kind] = float64(info.Value()) * float64(info.Value())
+	}
+	return weights
+}
+
+// LoadKindCatalogFile reads a catalog in the format of data/kindcatalog.csv
+func LoadKindCatalogFile(filename string) ([]KindInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 6
+
+	// skip the header
+	if _, err := r.Read(); err != nil {
+		return nil, err
+	}
+
+	out := make([]KindInfo, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := parseKindInfo(record)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		out = append(out, info)
+	}
+}
+
+func parseKindInfo(record []string) (KindInfo, error) {
+	info := KindInfo{Kind: record[0], Category: record[5]}
+	var err error
+	if info.Minerals, err = strconv.Atoi(record[1]); err != nil {
+		return info, fmt.Errorf("invalid minerals for %s: %w", info.Kind, err)
+	}
+	if info.Vespene, err = strconv.Atoi(record[2]); err != nil {
+		return info, fmt.Errorf("invalid vespene for %s: %w", info.Kind, err)
+	}
+	if info.Supply, err = strconv.ParseFloat(record[3], 64); err != nil {
+		return info, fmt.Errorf("invalid supply for %s: %w", info.Kind, err)
+	}
+	if info.BuildTime, err = strconv.ParseFloat(record[4], 64); err != nil {
+		return info, fmt.Errorf("invalid buildTime for %s: %w", info.Kind, err)
+	}
+	switch info.Category {
+	case CategoryWorker, CategoryArmy, CategoryStructure, CategoryUpgrade:
+	default:
+		return info, fmt.Errorf("invalid category for %s: %s", info.Kind, info.Category)
+	}
+	return info, nil
+}
@@ -0,0 +1,116 @@
+package src
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CompositionRef identifies a player's composition at a loop
+type CompositionRef struct {
+	GameID   int64
+	PlayerID int
+	LoopID   int64
+}
+
+type CompareParams struct {
+	GameID    int64 `form:"gameid" binding:"required"`
+	PlayerID  int   `form:"playerid" binding:"required"`
+	LoopID    int64 `form:"loop" binding:"required"`
+	GameID2   int64 `form:"gameid2" binding:"required"`
+	PlayerID2 int   `form:"playerid2" binding:"required"`
+	LoopID2   int64 `form:"loop2" binding:"required"`
+	// Lag is the number of loops before each loop to compare, the same as in
+	// the similar games search, 0 compares the whole game up to each loop like
+	// /composition
+	Lag     int64  `form:"lag"`
+	Metric  string `form:"metric"`
+	Weights string `form:"weights"`
+}
+
+func (p *CompareParams) Validate() error {
+	if p.LoopID < 0 || p.LoopID2 < 0 {
+		return fmt.Errorf("loop must not be negative")
+	}
+	if p.Lag < 0 {
+		return fmt.Errorf("lag must not be negative")
+	}
+	return nil
+}
+
+func (p *CompareParams) Refs() (CompositionRef, CompositionRef) {
+	return CompositionRef{p.GameID, p.PlayerID, p.LoopID}, CompositionRef{p.GameID2, p.PlayerID2, p.LoopID2}
+}
+
+// KindComparison is the count of a kind on each side of a comparison, see
+// compare() in schema.sql
+type KindComparison struct {
+	Kind    string `json:"kind"`
+	Player1 int    `json:"player1"`
+	Player2 int    `json:"player2"`
+	// Diff is Player1 - Player2
+	Diff int `json:"diff"`
+	// Weight is the kind's weight under the metric's weighting scheme
+	Weight float64 `json:"weight,omitempty"`
+}
+
+type Comparison struct {
+	Lag      int64            `json:"lag"`
+	Metric   string           `json:"metric"`
+	Kinds    []KindComparison `json:"kinds"`
+	Distance float64          `json:"distance"`
+}
+
+// CompareCompositions lines up two compositions by kind
+func CompareCompositions(a Composition, b Composition) []KindComparison {
+	byKind := make(map[string]*KindComparison)
+	kind := func(k string) *KindComparison {
+		out, ok := byKind[k]
+		if !ok {
+			out = &KindComparison{Kind: k}
+			byKind[k] = out
+		}
+		return out
+	}
+	for k, num := range a {
+		kind(k).Player1 = num
+	}
+	for k, num := range b {
+		kind(k).Player2 = num
+	}
+
+	out := make([]KindComparison, 0, len(byKind))
+	for _, row := range byKind {
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Kind < out[j].Kind
+	})
+	return out
+}
+
+// NewComparison computes the difference of each kind and the distance
+// between both sides under metric
+// Kinds which are zero on both sides are left out. The distance only covers
+// kinds in the registry, just like the similar games search.
+func NewComparison(rows []KindComparison, kinds *KindRegistry, lag int64, metric string, weights KindWeights) *Comparison {
+	out := &Comparison{Lag: lag, Metric: metric, Kinds: make([]KindComparison, 0, len(rows))}
+
+	a, b := make(Composition), make(Composition)
+	for _, row := range rows {
+		if row.Player1 == 0 && row.Player2 == 0 {
+			continue
+		}
+		row.Diff = row.Player1 - row.Player2
+		if weights != nil {
+			row.Weight = 1
+			if w, ok := weights[row.Kind]; ok {
+				row.Weight = w
+			}
+		}
+		out.Kinds = append(out.Kinds, row)
+		a[row.Kind], b[row.Kind] = row.Player1, row.Player2
+	}
+
+	out.Distance = Distance(metric, kinds.Vector(a), kinds.Vector(b), kinds.WeightVector(weights))
+	return out
+}
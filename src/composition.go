@@ -0,0 +1,119 @@
+package src
+
+import (
+	"fmt"
+	"sort"
+)
+
+type CompositionParams struct {
+	PlayerID int   `form:"playerid"`
+	LoopID   int64 `form:"loop" binding:"required"`
+	// Lag is how many loops before LoopID to sum events from, 0 is the whole
+	// game up to LoopID
+	Lag int64 `form:"lag"`
+	// Values adds the resources and supply of each kind from the kind catalog
+	Values bool `form:"values"`
+}
+
+func (p *CompositionParams) Validate() error {
+	if p.LoopID < 0 {
+		return fmt.Errorf("loop must not be negative")
+	}
+	if p.Lag < 0 {
+		return fmt.Errorf("lag must not be negative")
+	}
+	return nil
+}
+
+// MinLoop is the first loop included in the composition
+func (p *CompositionParams) MinLoop() int64 {
+	return WindowStart(p.LoopID, p.Lag)
+}
+
+// WindowStart is the first loop of the lag loops up to loop, a lag of 0
+// covers the whole game up to loop
+func WindowStart(loop int64, lag int64) int64 {
+	if lag == 0 || lag > loop {
+		return 0
+	}
+	return loop - lag
+}
+
+// KindValue is what some number of a kind cost, from the kind catalog
+type KindValue struct {
+	Minerals int     `json:"minerals"`
+	Vespene  int     `json:"vespene"`
+	Supply   float64 `json:"supply"`
+}
+
+func (v *KindValue) add(info *KindInfo, count int) {
+	v.Minerals += info.Minerals * count
+	v.Vespene += info.Vespene * count
+	v.Supply += info.Supply * float64(count)
+}
+
+type KindCount struct {
+	Kind  string `json:"kind"`
+	Count int    `json:"count"`
+	// Icon is the path of the kind's icon on the player api
+	Icon  string     `json:"icon"`
+	Value *KindValue `json:"value,omitempty"`
+}
+
+type PlayerComposition struct {
+	PlayerID int         `json:"playerid"`
+	Kinds    []KindCount `json:"kinds"`
+	// Value is the sum of Kinds, kinds missing from the catalog are left out
+	Value *KindValue `json:"value,omitempty"`
+}
+
+type GameComposition struct {
+	GameID  int64               `json:"gameid"`
+	LoopID  int64               `json:"loop"`
+	Lag     int64               `json:"lag"`
+	Players []PlayerComposition `json:"players"`
+}
+
+// NewGameComposition describes each player's composition, see
+// Timeline.Compositions
+// catalog is only used when params.Values is set.
+func NewGameComposition(gameID int64, params CompositionParams, comps map[int]Composition, catalog []KindInfo) *GameComposition {
+	infos := make(map[string]*KindInfo, len(catalog))
+	for i := range catalog {
+		infos[catalog[i].Kind] = &catalog[i]
+	}
+
+	if params.PlayerID != 0 {
+		comps = map[int]Composition{params.PlayerID: comps[params.PlayerID]}
+	}
+
+	out := &GameComposition{
+		GameID:  gameID,
+		LoopID:  params.LoopID,
+		Lag:     params.Lag,
+		Players: make([]PlayerComposition, 0, len(comps)),
+	}
+	for playerID, comp := range comps {
+		player := PlayerComposition{PlayerID: playerID, Kinds: make([]KindCount, 0, len(comp))}
+		if params.Values {
+			player.Value = &KindValue{}
+		}
+		for kind, count := range comp {
+			kc := KindCount{Kind: kind, Count: count, Icon: "/api/icon/" + kind}
+			if info, ok := infos[kind]; ok && params.Values {
+				kc.Value = &KindValue{}
+				kc.Value.add(info, count)
+				player.Value.add(info, count)
+			}
+			player.Kinds = append(player.Kinds, kc)
+		}
+		sort.Slice(player.Kinds, func(i, j int) bool {
+			return player.Kinds[i].Kind < player.Kinds[j].Kind
+		})
+		out.Players = append(out.Players, player)
+	}
+	sort.Slice(out.Players, func(i, j int) bool {
+		return out.Players[i].PlayerID < out.Players[j].PlayerID
+	})
+	return out
+}
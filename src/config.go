@@ -8,10 +8,37 @@ import (
 )
 
 type ProcessorConfig struct {
-	Verbose     int
-	NumWorkers  int
-	ReplayDir   string
-	Singlestore SinglestoreConfig
+	Verbose    int
+	NumWorkers int
+	ReplayDir  string
+	Watch      WatchConfig
+	Retry      RetryConfig
+	// DeadLetterFile lists the replays which failed to load, defaults to
+	// data/failed_replays.json
+	DeadLetterFile string
+	// MaxLoops skips replays with at least this many loops, 0 loads games of
+	// any length
+	MaxLoops int64
+	// SkipPostprocess publishes games without computing their compvecs, run
+	// `processor postprocess` once every game has been loaded
+	SkipPostprocess bool
+	Postprocess     PostprocessConfig
+	Engagements     EngagementConfig
+	Report          ReportConfig
+	Backend         string
+	Memory          MemoryConfig
+	Singlestore     SinglestoreConfig
+}
+
+func (c *ProcessorConfig) Store() StoreConfig {
+	return StoreConfig{Backend: c.Backend, Singlestore: c.Singlestore, Memory: c.Memory}
+}
+
+type WatchConfig struct {
+	// how often to scan ReplayDir for new replays
+	IntervalMs int
+	// how long a replay must remain unmodified before we process it
+	SettleMs int
 }
 
 type PlayerConfig struct {
@@ -20,9 +47,17 @@ type PlayerConfig struct {
 	IconDir     string
 	Port        int
 	GinMode     string
+	VectorIndex VectorIndexConfig
+	Metrics     MetricsConfig
+	Backend     string
+	Memory      MemoryConfig
 	Singlestore SinglestoreConfig
 }
 
+func (c *PlayerConfig) Store() StoreConfig {
+	return StoreConfig{Backend: c.Backend, Singlestore: c.Singlestore, Memory: c.Memory}
+}
+
 type SinglestoreConfig struct {
 	Host     string
 	Port     int
@@ -121,6 +121,98 @@ const (
 	TrackerEvtIDUnitDone = 7
 )
 
+// game event IDs are the same in every protocol version s2prot supports
+const (
+	/*
+		Cmd attributes
+			userid
+			cmdFlags
+			abil (null for commands without an ability, such as a right click)
+				abilLink
+				abilCmdIndex
+				abilCmdData
+			data (one of)
+				None
+				TargetPoint
+					x, y, z (fixed point, 4096 per map cell)
+				TargetUnit
+					tag
+					snapshotUnitLink
+					snapshotControlPlayerId
+					snapshotPoint
+				Data
+			sequence
+			otherUnit
+			unitGroup
+	*/
+	GameEvtIDCmd = 27
+
+	/*
+		SelectionDelta attributes
+			userid
+			controlGroupId (10 is the active selection)
+			delta
+				subgroupIndex
+				removeMask
+				addSubgroups
+				addUnitTags
+	*/
+	GameEvtIDSelectionDelta = 28
+
+	/*
+		ControlGroupUpdate attributes
+			userid
+			controlGroupIndex
+			controlGroupUpdate (0 set, 1 append, 2 recall, 3 clear)
+			mask
+	*/
+	GameEvtIDControlGroupUpdate = 29
+
+	/*
+		CameraUpdate attributes
+			userid
+			target (null when the camera didn't move)
+				x, y (fixed point, 256 per map cell)
+			distance
+			pitch
+			yaw
+			reason
+			follow
+	*/
+	GameEvtIDCameraUpdate = 49
+
+	/*
+		CmdUpdateTargetPoint attributes
+			userid
+			target
+				x, y, z (fixed point, 4096 per map cell)
+	*/
+	GameEvtIDCmdUpdateTargetPoint = 104
+
+	/*
+		CmdUpdateTargetUnit attributes
+			userid
+			target (same as Cmd data.TargetUnit)
+	*/
+	GameEvtIDCmdUpdateTargetUnit = 105
+)
+
+// values of GameEvent.EventType
+const (
+	GameEventCmd          = "cmd"
+	GameEventUpdateTarget = "updateTarget"
+	GameEventSelection    = "selection"
+	GameEventControlGroup = "controlGroup"
+	GameEventCamera       = "camera"
+)
+
+// values of UnitEvent.EventType
+const (
+	UnitEventBorn = "born"
+	UnitEventInit = "init"
+	UnitEventDied = "died"
+)
+
 var (
 	// IgnoreUnitTypeRe is a regex which matches unit types which should be ignored
 	IgnoreUnitTypeRe = regexp.MustCompile(`^(Beacon|RewardDance|Spray|LoadOutSpray|GameHeartActive|InvisibleTargetDummy|Larva|Egg|CreepTumor)`)
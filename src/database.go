@@ -6,14 +6,43 @@ import (
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/hamba/avro"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 )
 
 type Singlestore struct {
 	*sqlx.DB
+
+	playerStatsSchema avro.Schema
+	buildCompSchema   avro.Schema
+	gameEventSchema   avro.Schema
+	unitEventSchema   avro.Schema
+	engagementSchema  avro.Schema
 }
 
 func NewSinglestore(config SinglestoreConfig) (*Singlestore, error) {
+	statsSchema, err := AvroSchemaFromStruct(&PlayerStats{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert PlayerStats to avro schema")
+	}
+	buildCompSchema, err := AvroSchemaFromStruct(&BuildCompChange{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert BuildCompChange to avro schema")
+	}
+	gameEventSchema, err := AvroSchemaFromStruct(&GameEvent{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert GameEvent to avro schema")
+	}
+	unitEventSchema, err := AvroSchemaFromStruct(&UnitEvent{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert UnitEvent to avro schema")
+	}
+	engagementSchema, err := AvroSchemaFromStruct(&EngagementPlayer{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert EngagementPlayer to avro schema")
+	}
+
 	// We use NewConfig here to set default values. Then we override what we need to.
 	mysqlConf := mysql.NewConfig()
 	mysqlConf.User = config.Username
@@ -50,5 +79,13 @@ func NewSinglestore(config SinglestoreConfig) (*Singlestore, error) {
 	db.SetConnMaxLifetime(time.Hour)
 	db.SetMaxIdleConns(20)
 
-	return &Singlestore{DB: sqlx.NewDb(db, "mysql")}, nil
+	return &Singlestore{
+		DB: sqlx.NewDb(db, "mysql"),
+
+		playerStatsSchema: statsSchema,
+		buildCompSchema:   buildCompSchema,
+		gameEventSchema:   gameEventSchema,
+		unitEventSchema:   unitEventSchema,
+		engagementSchema:  engagementSchema,
+	}, nil
 }
@@ -0,0 +1,214 @@
+package src
+
+import "sort"
+
+// food values in PlayerStats are fixed point
+const foodScale = 4096
+
+// a player at this much supply is maxed out rather than supply blocked
+const maxFood = 200 * foodScale
+
+// DefaultBankThreshold is the unspent minerals and vespene above which a
+// player is floating resources
+const DefaultBankThreshold = 1000
+
+var workerKinds = map[string]bool{
+	"SCV":   true,
+	"Probe": true,
+	"Drone": true,
+}
+
+// every form of town hall, so upgrading or lifting one doesn't count as an
+// expansion
+var townHallKinds = map[string]bool{
+	"CommandCenter":        true,
+	"CommandCenterFlying":  true,
+	"OrbitalCommand":       true,
+	"OrbitalCommandFlying": true,
+	"PlanetaryFortress":    true,
+	"Nexus":                true,
+	"Hatchery":             true,
+	"Lair":                 true,
+	"Hive":                 true,
+}
+
+type EconomyParams struct {
+	// Bank is the unspent minerals and vespene above which a player is
+	// floating resources, defaults to DefaultBankThreshold
+	Bank int `form:"bank"`
+}
+
+type WorkerCount struct {
+	LoopID int64 `json:"loopid"`
+	Count  int   `json:"count"`
+}
+
+type LoopInterval struct {
+	StartLoop int64 `json:"startLoop"`
+	EndLoop   int64 `json:"endLoop"`
+}
+
+type FloatingInterval struct {
+	LoopInterval
+	// Peak is the most unspent minerals and vespene during the interval
+	Peak int `json:"peak"`
+}
+
+type Expansion struct {
+	LoopID int64  `json:"loopid"`
+	Kind   string `json:"kind"`
+	// TownHalls is the number of town halls the player had once it finished
+	TownHalls int `json:"townHalls"`
+}
+
+type PlayerEconomy struct {
+	PlayerID     int                `json:"playerid"`
+	Workers      []WorkerCount      `json:"workers"`
+	SupplyBlocks []LoopInterval     `json:"supplyBlocks"`
+	Floating     []FloatingInterval `json:"floating"`
+	Expansions   []Expansion        `json:"expansions"`
+}
+
+type Economy struct {
+	GameID  int64           `json:"gameid"`
+	Players []PlayerEconomy `json:"players"`
+}
+
+// ComputeEconomy derives each player's economy from a game's timeline
+// Worker counts and expansions come from the build composition changes, so
+// they change the moment a unit is born or a building finishes. Supply blocks
+// and floating come from the PlayerStats, which are only recorded every 10
+// seconds, so their intervals start and end on those samples.
+func ComputeEconomy(timeline *Timeline, params EconomyParams) *Economy {
+	bank := params.Bank
+	if bank <= 0 {
+		bank = DefaultBankThreshold
+	}
+
+	playerIDs := make(map[int]bool)
+	for _, evt := range timeline.Events {
+		playerIDs[evt.PlayerID] = true
+	}
+	for _, stats := range timeline.Stats {
+		playerIDs[stats.PlayerID] = true
+	}
+
+	out := &Economy{GameID: timeline.GameID, Players: make([]PlayerEconomy, 0, len(playerIDs))}
+	for playerID := range playerIDs {
+		out.Players = append(out.Players, PlayerEconomy{
+			PlayerID:     playerID,
+			Workers:      workerCounts(timeline.Events, playerID),
+			SupplyBlocks: supplyBlocks(timeline.Stats, playerID),
+			Floating:     floating(timeline.Stats, playerID, bank),
+			Expansions:   expansions(timeline.Events, playerID),
+		})
+	}
+	sort.Slice(out.Players, func(i, j int) bool {
+		return out.Players[i].PlayerID < out.Players[j].PlayerID
+	})
+	return out
+}
+
+// workerCounts returns the player's workers after each loop in which they
+// changed
+func workerCounts(events []Event, playerID int) []WorkerCount {
+	out := make([]WorkerCount, 0)
+	count := 0
+	for _, evt := range events {
+		if evt.PlayerID != playerID || !workerKinds[evt.Kind] {
+			continue
+		}
+		count += evt.Num
+		if len(out) > 0 && out[len(out)-1].LoopID == evt.LoopID {
+			out[len(out)-1].Count = count
+		} else {
+			out = append(out, WorkerCount{LoopID: evt.LoopID, Count: count})
+		}
+	}
+	return out
+}
+
+// statsIntervals returns the intervals during which cond holds for the
+// player's PlayerStats
+// An interval ends at the first sample for which cond no longer holds, or
+// the last sample.
+func statsIntervals(stats []Stats, playerID int, cond func(*Stats) bool, each func(interval *LoopInterval, stats *Stats)) []LoopInterval {
+	out := make([]LoopInterval, 0)
+	var current *LoopInterval
+	for i := range stats {
+		s := &stats[i]
+		if s.PlayerID != playerID {
+			continue
+		}
+		if current != nil {
+			current.EndLoop = s.LoopID
+		}
+		if !cond(s) {
+			current = nil
+			continue
+		}
+		if current == nil {
+			out = append(out, LoopInterval{StartLoop: s.LoopID, EndLoop: s.LoopID})
+			current = &out[len(out)-1]
+		}
+		if each != nil {
+			each(current, s)
+		}
+	}
+	return out
+}
+
+func supplyBlocks(stats []Stats, playerID int) []LoopInterval {
+	return statsIntervals(stats, playerID, func(s *Stats) bool {
+		return s.FoodMade < maxFood && s.FoodUsed >= s.FoodMade
+	}, nil)
+}
+
+func floating(stats []Stats, playerID int, bank int) []FloatingInterval {
+	banked := func(s *Stats) int {
+		return s.MineralsCurrent + s.VespeneCurrent
+	}
+
+	peaks := make(map[int64]int)
+	intervals := statsIntervals(stats, playerID, func(s *Stats) bool {
+		return banked(s) >= bank
+	}, func(interval *LoopInterval, s *Stats) {
+		if banked(s) > peaks[interval.StartLoop] {
+			peaks[interval.StartLoop] = banked(s)
+		}
+	})
+
+	out := make([]FloatingInterval, 0, len(intervals))
+	for _, interval := range intervals {
+		out = append(out, FloatingInterval{LoopInterval: interval, Peak: peaks[interval.StartLoop]})
+	}
+	return out
+}
+
+// expansions returns each loop in which the player's town halls increased,
+// other than the one they started with
+// Changes are summed over each loop, since upgrading a town hall removes one
+// kind and adds another in the same loop.
+func expansions(events []Event, playerID int) []Expansion {
+	out := make([]Expansion, 0)
+	count := 0
+	for i := 0; i < len(events); {
+		loop := events[i].LoopID
+		before := count
+		kind := ""
+		for ; i < len(events) && events[i].LoopID == loop; i++ {
+			evt := events[i]
+			if evt.PlayerID != playerID || !townHallKinds[evt.Kind] {
+				continue
+			}
+			count += evt.Num
+			if evt.Num > 0 {
+				kind = evt.Kind
+			}
+		}
+		if count > before && loop > 0 {
+			out = append(out, Expansion{LoopID: loop, Kind: kind, TownHalls: count})
+		}
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testStats is a PlayerStats sample for player 1, food is in whole supply
+func testStats(loop int64, foodUsed int, foodMade int, minerals int, vespene int) Stats {
+	return Stats{
+		PlayerID:        1,
+		LoopID:          loop,
+		FoodUsed:        foodUsed * foodScale,
+		FoodMade:        foodMade * foodScale,
+		MineralsCurrent: minerals,
+		VespeneCurrent:  vespene,
+	}
+}
+
+func TestComputeEconomy(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []Event
+		stats    []Stats
+		params   EconomyParams
+		expected PlayerEconomy
+	}{
+		{
+			name: "workers are counted after each loop",
+			events: []Event{
+				{PlayerID: 1, LoopID: 0, Kind: "Drone", Num: 12},
+				{PlayerID: 1, LoopID: 0, Kind: "Overlord", Num: 1},
+				{PlayerID: 1, LoopID: 272, Kind: "Drone", Num: 1},
+				{PlayerID: 1, LoopID: 500, Kind: "Drone", Num: -1},
+				{PlayerID: 1, LoopID: 500, Kind: "Drone", Num: 2},
+				{PlayerID: 2, LoopID: 600, Kind: "Probe", Num: 1},
+			},
+			expected: PlayerEconomy{
+				PlayerID:     1,
+				Workers:      []WorkerCount{{0, 12}, {272, 13}, {500, 14}},
+				SupplyBlocks: []LoopInterval{},
+				Floating:     []FloatingInterval{},
+				Expansions:   []Expansion{},
+			},
+		},
+		{
+			name: "supply blocks end at the first sample with free supply",
+			stats: []Stats{
+				testStats(160, 12, 14, 0, 0),
+				testStats(320, 14, 14, 0, 0),
+				testStats(480, 14, 14, 0, 0),
+				testStats(640, 15, 22, 0, 0),
+				testStats(800, 30, 30, 0, 0),
+			},
+			expected: PlayerEconomy{
+				PlayerID:     1,
+				Workers:      []WorkerCount{},
+				SupplyBlocks: []LoopInterval{{320, 640}, {800, 800}},
+				Floating:     []FloatingInterval{},
+				Expansions:   []Expansion{},
+			},
+		},
+		{
+			name: "a player at 200 supply is maxed rather than blocked",
+			stats: []Stats{
+				testStats(160, 198, 200, 0, 0),
+				testStats(320, 200, 200, 0, 0),
+				testStats(480, 192, 192, 0, 0),
+				testStats(640, 200, 200, 0, 0),
+			},
+			expected: PlayerEconomy{
+				PlayerID:     1,
+				Workers:      []WorkerCount{},
+				SupplyBlocks: []LoopInterval{{480, 640}},
+				Floating:     []FloatingInterval{},
+				Expansions:   []Expansion{},
+			},
+		},
+		{
+			name: "floating above the default bank",
+			stats: []Stats{
+				testStats(160, 10, 20, 800, 100),
+				testStats(320, 10, 20, 900, 100),
+				testStats(480, 10, 20, 1500, 200),
+				testStats(640, 10, 20, 1100, 0),
+				testStats(800, 10, 20, 300, 50),
+			},
+			expected: PlayerEconomy{
+				PlayerID:     1,
+				Workers:      []WorkerCount{},
+				SupplyBlocks: []LoopInterval{},
+				Floating:     []FloatingInterval{{LoopInterval{320, 800}, 1700}},
+				Expansions:   []Expansion{},
+			},
+		},
+		{
+			name: "floating above a custom bank",
+			stats: []Stats{
+				testStats(160, 10, 20, 400, 100),
+				testStats(320, 10, 20, 900, 100),
+			},
+			params: EconomyParams{Bank: 500},
+			expected: PlayerEconomy{
+				PlayerID:     1,
+				Workers:      []WorkerCount{},
+				SupplyBlocks: []LoopInterval{},
+				Floating:     []FloatingInterval{{LoopInterval{160, 320}, 1000}},
+				Expansions:   []Expansion{},
+			},
+		},
+		{
+			name: "morphing a hatchery into a lair isn't an expansion",
+			events: []Event{
+				{PlayerID: 1, LoopID: 0, Kind: "Hatchery", Num: 1},
+				{PlayerID: 1, LoopID: 1800, Kind: "Hatchery", Num: 1},
+				{PlayerID: 1, LoopID: 3000, Kind: "Hatchery", Num: -1},
+				{PlayerID: 1, LoopID: 3000, Kind: "Lair", Num: 1},
+				{PlayerID: 1, LoopID: 4000, Kind: "Lair", Num: -1},
+				{PlayerID: 1, LoopID: 4000, Kind: "Hive", Num: 1},
+				{PlayerID: 1, LoopID: 4500, Kind: "Hatchery", Num: 1},
+				{PlayerID: 1, LoopID: 4500, Kind: "Extractor", Num: 1},
+			},
+			expected: PlayerEconomy{
+				PlayerID:     1,
+				Workers:      []WorkerCount{},
+				SupplyBlocks: []LoopInterval{},
+				Floating:     []FloatingInterval{},
+				Expansions: []Expansion{
+					{LoopID: 1800, Kind: "Hatchery", TownHalls: 2},
+					{LoopID: 4500, Kind: "Hatchery", TownHalls: 3},
+				},
+			},
+		},
+		{
+			name: "lifting and upgrading command centers isn't an expansion",
+			events: []Event{
+				{PlayerID: 1, LoopID: 0, Kind: "CommandCenter", Num: 1},
+				{PlayerID: 1, LoopID: 1500, Kind: "CommandCenter", Num: -1},
+				{PlayerID: 1, LoopID: 1500, Kind: "OrbitalCommand", Num: 1},
+				{PlayerID: 1, LoopID: 2000, Kind: "CommandCenter", Num: 1},
+				{PlayerID: 1, LoopID: 2200, Kind: "CommandCenter", Num: -1},
+				{PlayerID: 1, LoopID: 2200, Kind: "CommandCenterFlying", Num: 1},
+				{PlayerID: 1, LoopID: 2600, Kind: "CommandCenterFlying", Num: -1},
+				{PlayerID: 1, LoopID: 2600, Kind: "CommandCenter", Num: 1},
+				{PlayerID: 2, LoopID: 2800, Kind: "Nexus", Num: 1},
+			},
+			expected: PlayerEconomy{
+				PlayerID:     1,
+				Workers:      []WorkerCount{},
+				SupplyBlocks: []LoopInterval{},
+				Floating:     []FloatingInterval{},
+				Expansions: []Expansion{
+					{LoopID: 2000, Kind: "CommandCenter", TownHalls: 2},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeline := &Timeline{GameID: 1, Events: tt.events, Stats: tt.stats}
+			economy := ComputeEconomy(timeline, tt.params)
+			if economy.GameID != 1 {
+				t.Errorf("unexpected game id %d", economy.GameID)
+			}
+			if len(economy.Players) == 0 || economy.Players[0].PlayerID != 1 {
+				t.Fatalf("expected player 1 first, found %+v", economy.Players)
+			}
+			if found := economy.Players[0]; !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("found %+v, expected %+v", found, tt.expected)
+			}
+		})
+	}
+}
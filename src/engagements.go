@@ -0,0 +1,260 @@
+package src
+
+import (
+	"math"
+	"sort"
+)
+
+type EngagementConfig struct {
+	// WindowLoops is the longest gap between two deaths in the same
+	// engagement, defaults to 160 (10 seconds)
+	WindowLoops int
+	// Radius is the furthest a death can be from the center of an engagement
+	// and still be part of it, in map cells, defaults to 15
+	Radius int
+	// MinDeaths is the fewest deaths which count as an engagement, defaults
+	// to 3
+	MinDeaths int
+}
+
+func (c EngagementConfig) windowLoops() int64 {
+	if c.WindowLoops <= 0 {
+		return 160
+	}
+	return int64(c.WindowLoops)
+}
+
+func (c EngagementConfig) radius() float64 {
+	if c.Radius <= 0 {
+		return 15
+	}
+	return float64(c.Radius)
+}
+
+func (c EngagementConfig) minDeaths() int {
+	if c.MinDeaths <= 0 {
+		return 3
+	}
+	return c.MinDeaths
+}
+
+// ResourcesLost is a player's cumulative resources lost at a loop, from the
+// scoreValueMineralsLost* and scoreValueVespeneLost* PlayerStats
+type ResourcesLost struct {
+	PlayerID int
+	LoopID   int64
+	Minerals int
+	Vespene  int
+}
+
+// Engagement is a fight, a group of unit deaths close together in time and
+// space
+type Engagement struct {
+	EngagementID int                `json:"id"`
+	StartLoop    int64              `json:"startLoop"`
+	EndLoop      int64              `json:"endLoop"`
+	X            float64            `json:"x"`
+	Y            float64            `json:"y"`
+	Players      []EngagementLosses `json:"players"`
+}
+
+// EngagementLosses is what one player lost and killed in an engagement
+// MineralsLost and VespeneLost come from the PlayerStats on either side of
+// the engagement, which are only sampled every 10 seconds, so they include
+// anything else the player lost around the same time.
+type EngagementLosses struct {
+	PlayerID     int `json:"playerid"`
+	UnitsLost    int `json:"unitsLost"`
+	UnitsKilled  int `json:"unitsKilled"`
+	MineralsLost int `json:"mineralsLost"`
+	VespeneLost  int `json:"vespeneLost"`
+}
+
+type GameEngagements struct {
+	GameID      int64        `json:"gameid"`
+	Engagements []Engagement `json:"engagements"`
+}
+
+// isCombatDeath returns true for units killed by another player
+// Units which died without a killer were cancelled, morphed or expired, and
+// neutral units are mostly minerals being mined out.
+func isCombatDeath(evt *UnitEvent) bool {
+	return evt.PlayerID != 0 &&
+		evt.KillerPlayerID != nil &&
+		*evt.KillerPlayerID != 0 &&
+		*evt.KillerPlayerID != evt.PlayerID
+}
+
+type engagementCluster struct {
+	deaths   []*UnitEvent
+	lastLoop int64
+	sumX     float64
+	sumY     float64
+}
+
+func (c *engagementCluster) center() (float64, float64) {
+	n := float64(len(c.deaths))
+	return c.sumX / n, c.sumY / n
+}
+
+func (c *engagementCluster) add(evt *UnitEvent) {
+	c.deaths = append(c.deaths, evt)
+	c.lastLoop = evt.LoopID
+	c.sumX += float64(evt.X)
+	c.sumY += float64(evt.Y)
+}
+
+// DetectEngagements groups the combat deaths of a game into engagements
+// Each death joins the closest engagement whose center is within Radius and
+// whose last death was within WindowLoops, or else starts a new one.
+// deaths and lost must be ordered by loop.
+func DetectEngagements(deaths []*UnitEvent, lost []ResourcesLost, config EngagementConfig) []Engagement {
+	window := config.windowLoops()
+	radius := config.radius()
+
+	clusters := make([]*engagementCluster, 0)
+	active := make([]*engagementCluster, 0)
+	for _, evt := range deaths {
+		if !isCombatDeath(evt) {
+			continue
+		}
+
+		var closest *engagementCluster
+		closestDist := math.Inf(1)
+		stillActive := active[:0]
+		for _, c := range active {
+			if evt.LoopID-c.lastLoop > window {
+				continue
+			}
+			stillActive = append(stillActive, c)
+
+			x, y := c.center()
+			dist := math.Hypot(float64(evt.X)-x, float64(evt.Y)-y)
+			if dist <= radius && dist < closestDist {
+				closest, closestDist = c, dist
+			}
+		}
+		active = stillActive
+
+		if closest == nil {
+			closest = &engagementCluster{}
+			clusters = append(clusters, closest)
+			active = append(active, closest)
+		}
+		closest.add(evt)
+	}
+
+	out := make([]Engagement, 0)
+	for _, c := range clusters {
+		if len(c.deaths) < config.minDeaths() {
+			continue
+		}
+		out = append(out, newEngagement(len(out)+1, c, lost))
+	}
+	return out
+}
+
+func newEngagement(id int, c *engagementCluster, lost []ResourcesLost) Engagement {
+	x, y := c.center()
+	out := Engagement{
+		EngagementID: id,
+		StartLoop:    c.deaths[0].LoopID,
+		EndLoop:      c.lastLoop,
+		X:            x,
+		Y:            y,
+	}
+
+	byPlayer := make(map[int]*EngagementLosses)
+	player := func(playerID int) *EngagementLosses {
+		losses, ok := byPlayer[playerID]
+		if !ok {
+			losses = &EngagementLosses{PlayerID: playerID}
+			byPlayer[playerID] = losses
+		}
+		return losses
+	}
+	for _, evt := range c.deaths {
+		player(evt.PlayerID).UnitsLost++
+		player(*evt.KillerPlayerID).UnitsKilled++
+	}
+
+	for playerID, losses := range byPlayer {
+		before := lostAt(lost, playerID, out.StartLoop, false)
+		after := lostAt(lost, playerID, out.EndLoop, true)
+		losses.MineralsLost = after.Minerals - before.Minerals
+		losses.VespeneLost = after.Vespene - before.Vespene
+		out.Players = append(out.Players, *losses)
+	}
+	sort.Slice(out.Players, func(i, j int) bool {
+		return out.Players[i].PlayerID < out.Players[j].PlayerID
+	})
+	return out
+}
+
+// lostAt returns a player's resources lost at the last sample before loop,
+// or the first sample after it if after is true
+// Nothing has been lost before the first sample, and the last sample is used
+// for loops after it.
+func lostAt(lost []ResourcesLost, playerID int, loop int64, after bool) ResourcesLost {
+	out := ResourcesLost{PlayerID: playerID}
+	for _, sample := range lost {
+		if sample.PlayerID != playerID {
+			continue
+		}
+		if sample.LoopID >= loop && !after {
+			break
+		}
+		out = sample
+		if sample.LoopID >= loop && after {
+			break
+		}
+	}
+	return out
+}
+
+// Rows flattens the engagement into one row per player for storage
+func (e *Engagement) Rows(gameID int64) []EngagementPlayer {
+	out := make([]EngagementPlayer, 0, len(e.Players))
+	for _, p := range e.Players {
+		out = append(out, EngagementPlayer{
+			GameID:       gameID,
+			EngagementID: e.EngagementID,
+			PlayerID:     p.PlayerID,
+			StartLoop:    e.StartLoop,
+			EndLoop:      e.EndLoop,
+			X:            e.X,
+			Y:            e.Y,
+			UnitsLost:    p.UnitsLost,
+			UnitsKilled:  p.UnitsKilled,
+			MineralsLost: p.MineralsLost,
+			VespeneLost:  p.VespeneLost,
+		})
+	}
+	return out
+}
+
+// GroupEngagements is the reverse of Rows, rows must be ordered by
+// EngagementID and PlayerID
+func GroupEngagements(rows []EngagementPlayer) []Engagement {
+	out := make([]Engagement, 0)
+	for _, row := range rows {
+		if len(out) == 0 || out[len(out)-1].EngagementID != row.EngagementID {
+			out = append(out, Engagement{
+				EngagementID: row.EngagementID,
+				StartLoop:    row.StartLoop,
+				EndLoop:      row.EndLoop,
+				X:            row.X,
+				Y:            row.Y,
+			})
+		}
+		e := &out[len(out)-1]
+		e.Players = append(e.Players, EngagementLosses{
+			PlayerID:     row.PlayerID,
+			UnitsLost:    row.UnitsLost,
+			UnitsKilled:  row.UnitsKilled,
+			MineralsLost: row.MineralsLost,
+			VespeneLost:  row.VespeneLost,
+		})
+	}
+	return out
+}
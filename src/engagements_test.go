@@ -0,0 +1,206 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testDeath is a unit of player's dying at loop, killer is nil for a unit
+// which died without a killer
+func testDeath(loop int64, player int, killer *int, x int, y int) *UnitEvent {
+	return &UnitEvent{
+		LoopID:         loop,
+		PlayerID:       player,
+		Kind:           "Zergling",
+		EventType:      "UnitDied",
+		X:              x,
+		Y:              y,
+		KillerPlayerID: killer,
+	}
+}
+
+func testPlayer(playerID int) *int {
+	return &playerID
+}
+
+// testLost is sampled every 10 seconds, like PlayerStats
+var testLost = []ResourcesLost{
+	{PlayerID: 1, LoopID: 160, Minerals: 100, Vespene: 0},
+	{PlayerID: 2, LoopID: 160, Minerals: 50, Vespene: 0},
+	{PlayerID: 1, LoopID: 320, Minerals: 250, Vespene: 25},
+	{PlayerID: 2, LoopID: 320, Minerals: 150, Vespene: 50},
+	{PlayerID: 1, LoopID: 480, Minerals: 400, Vespene: 50},
+	{PlayerID: 2, LoopID: 480, Minerals: 250, Vespene: 100},
+}
+
+func TestDetectEngagements(t *testing.T) {
+	p1, p2 := testPlayer(1), testPlayer(2)
+
+	tests := []struct {
+		name     string
+		deaths   []*UnitEvent
+		expected []Engagement
+	}{
+		{
+			name: "two separate fights at the same time",
+			deaths: []*UnitEvent{
+				testDeath(200, 2, p1, 10, 10),
+				testDeath(210, 1, p2, 100, 100),
+				testDeath(220, 2, p1, 12, 10),
+				testDeath(230, 1, p2, 102, 100),
+				testDeath(240, 2, p1, 10, 12),
+				testDeath(250, 1, p2, 101, 103),
+			},
+			expected: []Engagement{
+				{
+					EngagementID: 1, StartLoop: 200, EndLoop: 240, X: 32.0 / 3, Y: 32.0 / 3,
+					Players: []EngagementLosses{
+						{PlayerID: 1, UnitsKilled: 3, MineralsLost: 150, VespeneLost: 25},
+						{PlayerID: 2, UnitsLost: 3, MineralsLost: 100, VespeneLost: 50},
+					},
+				},
+				{
+					EngagementID: 2, StartLoop: 210, EndLoop: 250, X: 101, Y: 101,
+					Players: []EngagementLosses{
+						{PlayerID: 1, UnitsLost: 3, MineralsLost: 150, VespeneLost: 25},
+						{PlayerID: 2, UnitsKilled: 3, MineralsLost: 100, VespeneLost: 50},
+					},
+				},
+			},
+		},
+		{
+			name: "a gap longer than WindowLoops starts a new fight",
+			deaths: []*UnitEvent{
+				testDeath(200, 2, p1, 10, 10),
+				testDeath(220, 1, p2, 10, 10),
+				testDeath(240, 2, p1, 10, 10),
+				testDeath(401, 2, p1, 10, 10),
+				testDeath(420, 1, p2, 10, 10),
+				testDeath(440, 1, p2, 10, 10),
+			},
+			expected: []Engagement{
+				{
+					EngagementID: 1, StartLoop: 200, EndLoop: 240, X: 10, Y: 10,
+					Players: []EngagementLosses{
+						{PlayerID: 1, UnitsLost: 1, UnitsKilled: 2, MineralsLost: 150, VespeneLost: 25},
+						{PlayerID: 2, UnitsLost: 2, UnitsKilled: 1, MineralsLost: 100, VespeneLost: 50},
+					},
+				},
+				{
+					EngagementID: 2, StartLoop: 401, EndLoop: 440, X: 10, Y: 10,
+					Players: []EngagementLosses{
+						{PlayerID: 1, UnitsLost: 2, UnitsKilled: 1, MineralsLost: 150, VespeneLost: 25},
+						{PlayerID: 2, UnitsLost: 1, UnitsKilled: 2, MineralsLost: 100, VespeneLost: 50},
+					},
+				},
+			},
+		},
+		{
+			name: "a gap of exactly WindowLoops continues the fight",
+			deaths: []*UnitEvent{
+				testDeath(200, 2, p1, 10, 10),
+				testDeath(220, 2, p1, 10, 10),
+				testDeath(380, 2, p1, 10, 10),
+			},
+			expected: []Engagement{
+				{
+					EngagementID: 1, StartLoop: 200, EndLoop: 380, X: 10, Y: 10,
+					Players: []EngagementLosses{
+						{PlayerID: 1, UnitsKilled: 3, MineralsLost: 300, VespeneLost: 50},
+						{PlayerID: 2, UnitsLost: 3, MineralsLost: 200, VespeneLost: 100},
+					},
+				},
+			},
+		},
+		{
+			name: "deaths without a killer are ignored",
+			deaths: []*UnitEvent{
+				testDeath(200, 2, nil, 10, 10),
+				testDeath(220, 2, p1, 10, 10),
+				testDeath(230, 1, testPlayer(0), 10, 10),
+				testDeath(240, 2, p1, 10, 10),
+				testDeath(250, 2, p2, 10, 10),
+				testDeath(260, 2, p1, 10, 10),
+			},
+			expected: []Engagement{
+				{
+					EngagementID: 1, StartLoop: 220, EndLoop: 260, X: 10, Y: 10,
+					Players: []EngagementLosses{
+						{PlayerID: 1, UnitsKilled: 3, MineralsLost: 150, VespeneLost: 25},
+						{PlayerID: 2, UnitsLost: 3, MineralsLost: 100, VespeneLost: 50},
+					},
+				},
+			},
+		},
+		{
+			name: "too few deaths once those without a killer are ignored",
+			deaths: []*UnitEvent{
+				testDeath(200, 2, p1, 10, 10),
+				testDeath(220, 2, nil, 10, 10),
+				testDeath(240, 2, p1, 10, 10),
+			},
+			expected: []Engagement{},
+		},
+		{
+			name: "deaths further than Radius from the center",
+			deaths: []*UnitEvent{
+				testDeath(200, 2, p1, 10, 10),
+				testDeath(220, 2, p1, 10, 26),
+				testDeath(240, 2, p1, 10, 10),
+			},
+			expected: []Engagement{},
+		},
+		{
+			name: "before the first sample nothing has been lost",
+			deaths: []*UnitEvent{
+				testDeath(100, 2, p1, 10, 10),
+				testDeath(120, 2, p1, 10, 10),
+				testDeath(140, 2, p1, 10, 10),
+			},
+			expected: []Engagement{
+				{
+					EngagementID: 1, StartLoop: 100, EndLoop: 140, X: 10, Y: 10,
+					Players: []EngagementLosses{
+						{PlayerID: 1, UnitsKilled: 3, MineralsLost: 100, VespeneLost: 0},
+						{PlayerID: 2, UnitsLost: 3, MineralsLost: 50, VespeneLost: 0},
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found := DetectEngagements(tt.deaths, testLost, EngagementConfig{})
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("found %+v, expected %+v", found, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLostAt(t *testing.T) {
+	tests := []struct {
+		name     string
+		playerID int
+		loop     int64
+		after    bool
+		expected ResourcesLost
+	}{
+		{"before the first sample", 1, 100, false, ResourcesLost{PlayerID: 1}},
+		{"after the first sample", 1, 100, true, testLost[0]},
+		{"before a loop between samples", 2, 400, false, testLost[3]},
+		{"after a loop between samples", 2, 400, true, testLost[5]},
+		{"before a sampled loop", 1, 320, false, testLost[0]},
+		{"after a sampled loop", 1, 320, true, testLost[2]},
+		{"before a loop after the last sample", 1, 1000, false, testLost[4]},
+		{"after a loop after the last sample", 1, 1000, true, testLost[4]},
+		{"a player without samples", 3, 320, true, ResourcesLost{PlayerID: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if found := lostAt(testLost, tt.playerID, tt.loop, tt.after); found != tt.expected {
+				t.Errorf("found %+v, expected %+v", found, tt.expected)
+			}
+		})
+	}
+}
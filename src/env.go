@@ -1,38 +1,28 @@
 package src
 
-import (
-	"log"
-
-	"github.com/hamba/avro"
-)
-
 type ProcessorEnv struct {
 	WorkerID  int
-	DB        *Singlestore
+	Store     Store
+	Stats     *IngestStats
 	Verbose   int
 	ReplayDir string
-
-	PlayerStatsSchema avro.Schema
-	BuildCompSchema   avro.Schema
+	// SkipPostprocess publishes games without computing their compvecs
+	SkipPostprocess bool
+	// MaxLoops skips replays with at least this many loops, 0 disables it
+	MaxLoops    int64
+	Engagements EngagementConfig
 }
 
-func NewProcessorEnv(workerID int, config *ProcessorConfig, db *Singlestore) *ProcessorEnv {
-	statsSchema, err := AvroSchemaFromStruct(&PlayerStats{})
-	if err != nil {
-		log.Fatalf("failed to convert PlayerStats to avro schema: %s", err)
-	}
-	buildCompSchema, err := AvroSchemaFromStruct(&BuildCompChange{})
-	if err != nil {
-		log.Fatalf("failed to convert BuildCompChange to avro schema: %s", err)
-	}
-
+func NewProcessorEnv(workerID int, config *ProcessorConfig, store Store, stats *IngestStats) *ProcessorEnv {
 	return &ProcessorEnv{
 		WorkerID:  workerID,
-		DB:        db,
+		Store:     store,
+		Stats:     stats,
 		Verbose:   config.Verbose,
 		ReplayDir: config.ReplayDir,
 
-		PlayerStatsSchema: statsSchema,
-		BuildCompSchema:   buildCompSchema,
+		SkipPostprocess: config.SkipPostprocess,
+		MaxLoops:        config.MaxLoops,
+		Engagements:     config.Engagements,
 	}
 }
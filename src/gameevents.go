@@ -0,0 +1,123 @@
+package src
+
+import (
+	"github.com/icza/s2prot"
+	"github.com/icza/s2prot/rep"
+)
+
+// game events store positions as fixed point numbers
+const (
+	targetPointScale = 4096
+	cameraPointScale = 256
+)
+
+// gameEventPlayerIDs maps the user IDs in game events to player IDs
+// Players are matched to users by their working set slot. Observers have a
+// user ID but no player, so their events are dropped.
+func gameEventPlayerIDs(replay *rep.Rep) map[int64]int {
+	players := replay.Details.Players()
+	out := make(map[int64]int)
+
+	for i := range players {
+		slot, ok := playerSlot(replay, i)
+		if ok && slot.Value("userId") != nil {
+			out[slot.UserID()] = i + 1
+		}
+	}
+
+	// replays from before working set slots were recorded list the users in
+	// the same order as the players
+	if len(out) == 0 {
+		for i := range players {
+			out[int64(i)] = i + 1
+		}
+	}
+	return out
+}
+
+func intPtr(v int64) *int {
+	i := int(v)
+	return &i
+}
+
+// readTargetUnit fills in the target of a cmd or updateTarget event from a
+// TargetUnit struct
+func readTargetUnit(out *GameEvent, target s2prot.Struct, unitMap map[int64]*UnitInfo) {
+	tag := target.Int("tag")
+	out.TargetUnitTag = &tag
+	if unitInfo, ok := unitMap[tag]; ok {
+		unitType := unitInfo.UnitType
+		out.TargetUnitType = &unitType
+	}
+
+	x := float64(target.Int("snapshotPoint", "x")) / targetPointScale
+	y := float64(target.Int("snapshotPoint", "y")) / targetPointScale
+	out.TargetX, out.TargetY = &x, &y
+}
+
+// readTargetPoint fills in the target of a cmd or updateTarget event from a
+// TargetPoint struct
+func readTargetPoint(out *GameEvent, target s2prot.Struct) {
+	x := float64(target.Int("x")) / targetPointScale
+	y := float64(target.Int("y")) / targetPointScale
+	out.TargetX, out.TargetY = &x, &y
+}
+
+// parseGameEvent converts the game events we keep into a GameEvent
+// unitMap is used to look up the type of targeted units, so it must contain
+// every unit in the game.
+func parseGameEvent(evt s2prot.Event, gameID int64, playerIDs map[int64]int, unitMap map[int64]*UnitInfo) (*GameEvent, bool) {
+	playerID, ok := playerIDs[evt.UserID()]
+	if !ok {
+		return nil, false
+	}
+
+	out := &GameEvent{
+		GameID:   gameID,
+		PlayerID: playerID,
+		LoopID:   evt.Loop(),
+	}
+
+	switch evt.ID {
+	case GameEvtIDCmd:
+		out.EventType = GameEventCmd
+		out.CmdFlags = intPtr(evt.Int("cmdFlags"))
+		if evt.Value("abil") != nil {
+			out.AbilityLink = intPtr(evt.Int("abil", "abilLink"))
+			out.AbilityCmdIndex = intPtr(evt.Int("abil", "abilCmdIndex"))
+		}
+		if target := evt.Structv("data", "TargetPoint"); target != nil {
+			readTargetPoint(out, target)
+		}
+		if target := evt.Structv("data", "TargetUnit"); target != nil {
+			readTargetUnit(out, target, unitMap)
+		}
+	case GameEvtIDCmdUpdateTargetPoint:
+		out.EventType = GameEventUpdateTarget
+		readTargetPoint(out, evt.Structv("target"))
+	case GameEvtIDCmdUpdateTargetUnit:
+		out.EventType = GameEventUpdateTarget
+		readTargetUnit(out, evt.Structv("target"), unitMap)
+	case GameEvtIDSelectionDelta:
+		out.EventType = GameEventSelection
+		out.ControlGroup = intPtr(evt.Int("controlGroupId"))
+		out.UnitsAdded = intPtr(int64(len(evt.Array("delta", "addUnitTags"))))
+	case GameEvtIDControlGroupUpdate:
+		out.EventType = GameEventControlGroup
+		out.ControlGroup = intPtr(evt.Int("controlGroupIndex"))
+		out.ControlGroupAction = intPtr(evt.Int("controlGroupUpdate"))
+	case GameEvtIDCameraUpdate:
+		// the camera also sends updates when only its zoom or angle changed
+		if evt.Value("target") == nil {
+			return nil, false
+		}
+		out.EventType = GameEventCamera
+		x := float64(evt.Int("target", "x")) / cameraPointScale
+		y := float64(evt.Int("target", "y")) / cameraPointScale
+		out.TargetX, out.TargetY = &x, &y
+	default:
+		return nil, false
+	}
+
+	return out, true
+}
@@ -0,0 +1,229 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stages of Run, recorded in a RunError
+const (
+	StageCheck   = "check"
+	StageParse   = "parse"
+	StageLoad    = "load"
+	StagePublish = "publish"
+	// StagePanic records a panic in any stage, which is a bug in either the
+	// processor or s2prot
+	StagePanic = "panic"
+)
+
+// RunError records which stage of Run failed
+type RunError struct {
+	Stage  string
+	GameID int64
+	Err    error
+	// Stack is the stack trace of a panic
+	Stack string
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Stage, e.Err)
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// Transient returns true if running the replay again might succeed
+// Parse errors and panics come from the replay itself, everything else talks
+// to the store and may be caused by a network or database hiccup.
+func (e *RunError) Transient() bool {
+	return e.Stage != StageParse && e.Stage != StagePanic
+}
+
+type RetryConfig struct {
+	// MaxAttempts is the number of times a replay is run before it is
+	// recorded as failed, defaults to 3
+	MaxAttempts int
+	// BackoffMs is the delay before the first retry, it doubles after each
+	// attempt, defaults to 1000
+	BackoffMs int
+}
+
+// RunWithRetry runs a replay, retrying transient errors with exponential
+// backoff
+// It returns the number of attempts made and the last error. Retries are
+// abandoned early if shutdown is closed.
+func RunWithRetry(env *ProcessorEnv, filename string, config RetryConfig, shutdown <-chan struct{}) (int, error) {
+	maxAttempts := config.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	backoff := time.Duration(config.BackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := Run(env, filename)
+
+		var runErr *RunError
+		if err == nil || attempt >= maxAttempts || (errors.As(err, &runErr) && !runErr.Transient()) {
+			return attempt, err
+		}
+
+		if env.Verbose >= VerboseInfo {
+			log.Printf("attempt %d of %s failed, retrying in %s: %s", attempt, filename, backoff, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-shutdown:
+			return attempt, err
+		}
+		backoff *= 2
+	}
+}
+
+// FailedFile is a replay which could not be loaded
+type FailedFile struct {
+	Path   string `json:"path"`
+	GameID int64  `json:"gameid"`
+	Stage  string `json:"stage"`
+	Error  string `json:"error"`
+	// Stack is the stack trace of a panic
+	Stack string `json:"stack,omitempty"`
+	// Attempts is the total number of attempts over every run
+	Attempts int `json:"attempts"`
+	// Quarantined files failed to parse or panicked, so retrying them won't help until
+	// the replay or the parser changes
+	Quarantined bool      `json:"quarantined"`
+	FailedAt    time.Time `json:"failedAt"`
+}
+
+// DeadLetters is a JSON file listing the replays which failed to load
+// Files are removed from it once they are loaded successfully.
+type DeadLetters struct {
+	path string
+
+	mu    sync.Mutex
+	files map[string]*FailedFile
+}
+
+// OpenDeadLetters reads the dead letter file at path, which may not exist yet
+func OpenDeadLetters(path string) (*DeadLetters, error) {
+	d := &DeadLetters{
+		path:  path,
+		files: make(map[string]*FailedFile),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*FailedFile, 0)
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	for _, f := range files {
+		d.files[f.Path] = f
+	}
+	return d, nil
+}
+
+// Record adds or updates a failed file
+func (d *DeadLetters) Record(path string, attempts int, err error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.files[path]
+	if !ok {
+		f = &FailedFile{Path: path}
+		d.files[path] = f
+	}
+	f.Attempts += attempts
+	f.Error = err.Error()
+	f.FailedAt = time.Now().UTC()
+	f.Stage = ""
+	f.Stack = ""
+	f.Quarantined = false
+
+	var runErr *RunError
+	if errors.As(err, &runErr) {
+		f.GameID = runErr.GameID
+		f.Stage = runErr.Stage
+		f.Error = runErr.Err.Error()
+		f.Stack = runErr.Stack
+		f.Quarantined = !runErr.Transient()
+	}
+
+	return d.saveLocked()
+}
+
+// Resolve removes a file which has now been loaded
+func (d *DeadLetters) Resolve(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.files[path]; !ok {
+		return nil
+	}
+	delete(d.files, path)
+	return d.saveLocked()
+}
+
+// Files returns every failed file ordered by path
+func (d *DeadLetters) Files() []FailedFile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := make([]FailedFile, 0, len(d.files))
+	for _, f := range d.files {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+func (d *DeadLetters) saveLocked() error {
+	files := make([]*FailedFile, 0, len(d.files))
+	for _, f := range d.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so the list is never truncated
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), filepath.Base(d.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
@@ -0,0 +1,292 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// reasons a replay is skipped by Run
+const (
+	SkipAlreadyLoaded = "already_loaded"
+	SkipPlayers       = "players"
+	SkipTooLong       = "too_long"
+)
+
+// tables written by Run, used to count rows
+const (
+	TableGames       = "games"
+	TablePlayers     = "players"
+	TablePlayerStats = "playerstats"
+	TableBuildComp   = "buildcomp"
+	TableGameEvents  = "gameevents"
+	TableUnitEvents  = "unitevents"
+	TableEngagements = "engagements"
+)
+
+var stageBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type ReportConfig struct {
+	// File is where the JSON report is written at exit, defaults to
+	// data/ingest_report.json
+	File string
+	// IntervalMs is how often progress is logged, defaults to 10000
+	IntervalMs int
+	// MetricsPort serves Prometheus metrics on /metrics while the processor
+	// runs, disabled when 0
+	MetricsPort int
+}
+
+// StageTiming summarizes the time spent in one stage of Run
+type StageTiming struct {
+	Count    int64   `json:"count"`
+	TotalSec float64 `json:"totalSec"`
+	MeanSec  float64 `json:"meanSec"`
+	MaxSec   float64 `json:"maxSec"`
+}
+
+// IngestReport is the JSON report written at the end of a processor run
+type IngestReport struct {
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	ElapsedSec float64   `json:"elapsedSec"`
+
+	// FilesTotal is the number of replays expected, 0 if unknown
+	FilesTotal   int64            `json:"filesTotal"`
+	FilesSeen    int64            `json:"filesSeen"`
+	FilesLoaded  int64            `json:"filesLoaded"`
+	FilesSkipped map[string]int64 `json:"filesSkipped"`
+	FilesFailed  int64            `json:"filesFailed"`
+	FilesPerSec  float64          `json:"filesPerSec"`
+
+	// Events counts the tracker and game events of every loaded replay
+	Events       int64   `json:"events"`
+	EventsPerSec float64 `json:"eventsPerSec"`
+
+	Rows   map[string]int64       `json:"rows"`
+	Stages map[string]StageTiming `json:"stages"`
+}
+
+// IngestStats collects statistics about a processor run
+// It is shared by every worker. All methods may be called on a nil
+// *IngestStats, in which case they do nothing.
+type IngestStats struct {
+	Metrics *MetricsRegistry
+
+	mu         sync.Mutex
+	command    string
+	startedAt  time.Time
+	filesTotal int64
+	seen       int64
+	loaded     int64
+	skipped    map[string]int64
+	failed     int64
+	events     int64
+	rows       map[string]int64
+	stages     map[string]*StageTiming
+
+	filesCounter   *Counter
+	skippedCounter *Counter
+	eventsCounter  *Counter
+	rowsCounter    *Counter
+	stageHistogram *Histogram
+	totalGauge     *Gauge
+}
+
+func NewIngestStats(command string) *IngestStats {
+	metrics := NewMetricsRegistry()
+	s := &IngestStats{
+		Metrics:   metrics,
+		command:   command,
+		startedAt: time.Now(),
+		skipped:   make(map[string]int64),
+		rows:      make(map[string]int64),
+		stages:    make(map[string]*StageTiming),
+
+		filesCounter:   metrics.NewCounter("processor_files_total", "Replays processed by outcome.", "outcome"),
+		skippedCounter: metrics.NewCounter("processor_files_skipped_total", "Replays skipped by reason.", "reason"),
+		eventsCounter:  metrics.NewCounter("processor_events_total", "Tracker and game events in loaded replays."),
+		rowsCounter:    metrics.NewCounter("processor_rows_total", "Rows written to each table by loaded replays.", "table"),
+		stageHistogram: metrics.NewHistogram("processor_stage_seconds", "Time spent in each stage of loading a replay.", stageBuckets, "stage"),
+		totalGauge:     metrics.NewGauge("processor_files_expected", "Replays expected in this run, 0 if unknown."),
+	}
+	s.totalGauge.Set(0)
+	return s
+}
+
+// SetTotal records the number of replays expected in this run
+func (s *IngestStats) SetTotal(total int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.filesTotal = total
+	s.mu.Unlock()
+	s.totalGauge.Set(float64(total))
+}
+
+// Seen is called when a worker picks up a replay
+func (s *IngestStats) Seen() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.seen++
+	s.mu.Unlock()
+	s.filesCounter.Inc("seen")
+}
+
+// Loaded is called once a replay has been published
+func (s *IngestStats) Loaded(events int64, rows map[string]int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.loaded++
+	s.events += events
+	for table, n := range rows {
+		s.rows[table] += n
+	}
+	s.mu.Unlock()
+
+	s.filesCounter.Inc("loaded")
+	s.eventsCounter.Add(float64(events))
+	for table, n := range rows {
+		s.rowsCounter.Add(float64(n), table)
+	}
+}
+
+func (s *IngestStats) Skipped(reason string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.skipped[reason]++
+	s.mu.Unlock()
+	s.filesCounter.Inc("skipped")
+	s.skippedCounter.Inc(reason)
+}
+
+// Failed is called when a replay has failed after every retry
+func (s *IngestStats) Failed() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed++
+	s.mu.Unlock()
+	s.filesCounter.Inc("failed")
+}
+
+// ObserveStage records the time spent in one stage of Run, including stages
+// which failed or were retried
+func (s *IngestStats) ObserveStage(stage string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	sec := d.Seconds()
+
+	s.mu.Lock()
+	t, ok := s.stages[stage]
+	if !ok {
+		t = &StageTiming{}
+		s.stages[stage] = t
+	}
+	t.Count++
+	t.TotalSec += sec
+	if sec > t.MaxSec {
+		t.MaxSec = sec
+	}
+	s.mu.Unlock()
+
+	s.stageHistogram.Observe(sec, stage)
+}
+
+// Report returns a snapshot of the statistics
+func (s *IngestStats) Report() IngestReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.startedAt).Seconds()
+
+	report := IngestReport{
+		Command:      s.command,
+		StartedAt:    s.startedAt.UTC(),
+		FinishedAt:   now.UTC(),
+		ElapsedSec:   elapsed,
+		FilesTotal:   s.filesTotal,
+		FilesSeen:    s.seen,
+		FilesLoaded:  s.loaded,
+		FilesSkipped: make(map[string]int64, len(s.skipped)),
+		FilesFailed:  s.failed,
+		Events:       s.events,
+		Rows:         make(map[string]int64, len(s.rows)),
+		Stages:       make(map[string]StageTiming, len(s.stages)),
+	}
+	if elapsed > 0 {
+		report.FilesPerSec = float64(s.seen) / elapsed
+		report.EventsPerSec = float64(s.events) / elapsed
+	}
+	for reason, n := range s.skipped {
+		report.FilesSkipped[reason] = n
+	}
+	for table, n := range s.rows {
+		report.Rows[table] = n
+	}
+	for stage, t := range s.stages {
+		timing := *t
+		timing.MeanSec = t.TotalSec / float64(t.Count)
+		report.Stages[stage] = timing
+	}
+	return report
+}
+
+// Progress returns a single line describing the progress of the run
+func (r *IngestReport) Progress() string {
+	var skipped int64
+	for _, n := range r.FilesSkipped {
+		skipped += n
+	}
+
+	total := "?"
+	if r.FilesTotal > 0 {
+		total = fmt.Sprint(r.FilesTotal)
+	}
+	line := fmt.Sprintf("progress: %d/%s files (%d loaded, %d skipped, %d failed), %.2f files/s, %.0f events/s",
+		r.FilesSeen, total, r.FilesLoaded, skipped, r.FilesFailed, r.FilesPerSec, r.EventsPerSec)
+
+	if r.FilesTotal > 0 && r.FilesPerSec > 0 && r.FilesSeen < r.FilesTotal {
+		eta := time.Duration(float64(r.FilesTotal-r.FilesSeen) / r.FilesPerSec * float64(time.Second))
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return line
+}
+
+// LogStages logs the time spent in each stage, slowest first
+func (r *IngestReport) LogStages() {
+	stages := make([]string, 0, len(r.Stages))
+	for stage := range r.Stages {
+		stages = append(stages, stage)
+	}
+	sort.Slice(stages, func(i, j int) bool {
+		return r.Stages[stages[i]].TotalSec > r.Stages[stages[j]].TotalSec
+	})
+	for _, stage := range stages {
+		t := r.Stages[stage]
+		log.Printf("  %s: %d runs, %.1fs total, %.3fs mean, %.3fs max", stage, t.Count, t.TotalSec, t.MeanSec, t.MaxSec)
+	}
+}
+
+func (r *IngestReport) WriteFile(filename string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
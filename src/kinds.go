@@ -0,0 +1,114 @@
+package src
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Composition is the number of units, buildings and upgrades of each kind a
+// player has over some window of the game
+type Composition map[string]int
+
+func (c Composition) Equal(other Composition) bool {
+	if len(c) != len(other) {
+		return false
+	}
+	for kind, num := range c {
+		if n, ok := other[kind]; !ok || n != num {
+			return false
+		}
+	}
+	return true
+}
+
+// KindRegistry maps each kind to its dimension in a composition vector
+// Dimensions are append-only (see uniquekind in schema.sql) so the version of
+// the registry is simply the number of kinds it contains, and a vector from an
+// older version can be re-projected onto a newer one by padding it with zeros.
+type KindRegistry struct {
+	kinds []string
+	dims  map[string]int
+}
+
+// NewKindRegistry creates a registry from a list of kinds ordered by dimension
+func NewKindRegistry(kinds []string) *KindRegistry {
+	dims := make(map[string]int, len(kinds))
+	for i, kind := range kinds {
+		dims[kind] = i
+	}
+	return &KindRegistry{kinds: kinds, dims: dims}
+}
+
+func (r *KindRegistry) Version() int64 {
+	return int64(len(r.kinds))
+}
+
+func (r *KindRegistry) Kinds() []string {
+	return r.kinds
+}
+
+func (r *KindRegistry) Dim(kind string) (int, bool) {
+	dim, ok := r.dims[kind]
+	return dim, ok
+}
+
+// Covers returns true if every kind in comp has a dimension in the registry
+func (r *KindRegistry) Covers(comp Composition) bool {
+	for kind := range comp {
+		if _, ok := r.dims[kind]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Vector converts a composition into a vector at the current version
+// Kinds which are not in the registry are dropped, no stored vector has a
+// dimension for them so they would add the same distance to every result.
+func (r *KindRegistry) Vector(comp Composition) []float32 {
+	vec := make([]float32, len(r.kinds))
+	for kind, num := range comp {
+		if dim, ok := r.dims[kind]; ok {
+			vec[dim] = float32(num)
+		}
+	}
+	return vec
+}
+
+// Project re-projects a vector computed at version onto the current version
+// An error is returned if the vector can't be re-projected, either because it
+// is newer than the registry or because its length doesn't match its version.
+func (r *KindRegistry) Project(vec []float32, version int64) ([]float32, error) {
+	if int64(len(vec)) != version {
+		return nil, fmt.Errorf("vector has %d dimensions but claims to be version %d", len(vec), version)
+	}
+	if version > r.Version() {
+		return nil, fmt.Errorf("vector version %d is newer than kind registry version %d", version, r.Version())
+	}
+	if version == r.Version() {
+		return vec, nil
+	}
+
+	out := make([]float32, len(r.kinds))
+	copy(out, vec)
+	return out, nil
+}
+
+// PackVector encodes a vector in the same format as json_array_pack
+func PackVector(vec []float32) []byte {
+	out := make([]byte, len(vec)*4)
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(out[i*4:], math.Float32bits(v))
+	}
+	return out
+}
+
+// UnpackVector decodes a vector produced by json_array_pack
+func UnpackVector(data []byte) []float32 {
+	vec := make([]float32, len(data)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return vec
+}
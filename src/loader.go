@@ -53,6 +53,8 @@ func (l *Loader) Encode(row interface{}) error {
 	return l.encoder.Encode(row)
 }
 
+// Close flushes the stream and waits for the load to finish
+// Calling Close more than once is safe, subsequent calls return nil.
 func (l *Loader) Close() error {
 	// close the writer
 	err := l.pipewriter.Close()
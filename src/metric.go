@@ -0,0 +1,127 @@
+package src
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	MetricEuclidean         = "euclidean"
+	MetricCosine            = "cosine"
+	MetricWeightedEuclidean = "weighted-euclidean"
+)
+
+// WeightsTFIDF weights each kind by its inverse document frequency, where
+// each player in each game is a document
+// Kinds which every player builds, like workers, count for less than rare
+// units. See tfidfWeights in schema.sql.
+const WeightsTFIDF = "tfidf"
+
+// KindWeights is the weight of each kind under some weighting scheme
+// Kinds without a weight have a weight of 1.
+type KindWeights map[string]float64
+
+// ValidateMetric checks that a metric and weighting scheme can be combined
+// and returns the metric to use, which defaults to euclidean
+func ValidateMetric(metric string, scheme string) (string, string, error) {
+	switch metric {
+	case "", MetricEuclidean:
+		if scheme != "" {
+			return "", "", fmt.Errorf("the %s metric does not support weights, use %s", MetricEuclidean, MetricWeightedEuclidean)
+		}
+		return MetricEuclidean, "", nil
+	case MetricCosine:
+		return metric, scheme, nil
+	case MetricWeightedEuclidean:
+		if scheme == "" {
+			scheme = WeightsTFIDF
+		}
+		return metric, scheme, nil
+	default:
+		return "", "", fmt.Errorf("unknown metric: %s", metric)
+	}
+}
+
+// WeightVector returns the weight of each dimension, or nil if weights is nil
+func (r *KindRegistry) WeightVector(weights KindWeights) []float32 {
+	if weights == nil {
+		return nil
+	}
+	out := make([]float32, len(r.kinds))
+	for i, kind := range r.kinds {
+		w, ok := weights[kind]
+		if !ok {
+			w = 1
+		}
+		out[i] = float32(w)
+	}
+	return out
+}
+
+// SqrtVector returns the square root of each element of vec
+// Scaling both vectors by the square root of the weights turns
+// EUCLIDEAN_DISTANCE and DOT_PRODUCT into their weighted versions.
+func SqrtVector(vec []float32) []float32 {
+	out := make([]float32, len(vec))
+	for i, v := range vec {
+		out[i] = float32(math.Sqrt(float64(v)))
+	}
+	return out
+}
+
+// Distance computes the distance between two vectors under metric
+// Shorter vectors are padded with zeros. weights may be nil, in which case
+// every dimension has a weight of 1.
+func Distance(metric string, a []float32, b []float32, weights []float32) float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	at := func(vec []float32, i int) float64 {
+		if i < len(vec) {
+			return float64(vec[i])
+		}
+		return 0
+	}
+	weight := func(i int) float64 {
+		if weights == nil {
+			return 1
+		}
+		return at(weights, i)
+	}
+
+	switch metric {
+	case MetricCosine:
+		var dot, normA, normB float64
+		for i := 0; i < n; i++ {
+			w, x, y := weight(i), at(a, i), at(b, i)
+			dot += w * x * y
+			normA += w * x * x
+			normB += w * y * y
+		}
+		return cosineDistance(dot, normA, normB)
+	default:
+		var sum float64
+		for i := 0; i < n; i++ {
+			d := at(a, i) - at(b, i)
+			sum += weight(i) * d * d
+		}
+		return math.Sqrt(sum)
+	}
+}
+
+// cosineDistance is 1 minus the cosine similarity
+// A zero vector has a distance of 1 from everything, matching the ifnull in
+// similarWeightedPoints.
+func cosineDistance(dot float64, normA float64, normB float64) float64 {
+	if normA == 0 || normB == 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(normA*normB)
+}
+
+// inverseDocumentFrequency returns the smoothed idf of a kind which appears
+// in df out of n documents
+func inverseDocumentFrequency(df int, n int) float64 {
+	return math.Log(float64(1+n)/float64(1+df)) + 1
+}
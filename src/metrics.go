@@ -0,0 +1,262 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLatencyBuckets are histogram buckets in seconds suitable for
+// request and query latencies
+var DefaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricsRegistry renders metrics in the Prometheus text exposition format
+// We only need a handful of counters, gauges and histograms, which isn't worth
+// pulling in the full client library for.
+type MetricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metricFamily
+}
+
+type metricFamily interface {
+	write(w io.Writer)
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+func (r *MetricsRegistry) register(m metricFamily) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Render writes every metric in the order they were registered
+func (r *MetricsRegistry) Render(w io.Writer) {
+	r.mu.Lock()
+	metrics := make([]metricFamily, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	buf.Flush()
+}
+
+// ServeHTTP serves the metrics so the registry can be mounted at /metrics
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Render(w)
+}
+
+// metricVec holds the series of a metric, one for each set of label values
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// only used by histograms
+	counts []uint64
+	sum    float64
+}
+
+func newMetricVec(name string, help string, kind string, labels []string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+}
+
+// get returns the series for labelValues, the caller must hold v.mu
+func (v *metricVec) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) sortedSeries() []*metricSeries {
+	out := make([]*metricSeries, 0, len(v.series))
+	for _, s := range v.series {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, "\xff") < strings.Join(out[j].labelValues, "\xff")
+	})
+	return out
+}
+
+// helpEscaper escapes a HELP line, which unlike label values keeps quotes
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// labelEscaper escapes a label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, helpEscaper.Replace(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w)
+	for _, s := range v.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+	}
+}
+
+type Counter struct {
+	vec *metricVec
+}
+
+func (r *MetricsRegistry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newMetricVec(name, help, "counter", labels)}
+	r.register(c.vec)
+	return c
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.vec.mu.Lock()
+	defer c.vec.mu.Unlock()
+	c.vec.get(labelValues).value += value
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+type Gauge struct {
+	vec *metricVec
+}
+
+func (r *MetricsRegistry) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{newMetricVec(name, help, "gauge", labels)}
+	r.register(g.vec)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.vec.mu.Lock()
+	defer g.vec.mu.Unlock()
+	g.vec.get(labelValues).value = value
+}
+
+// valueFunc is a metric whose value is computed when the metrics are scraped
+type valueFunc struct {
+	vec *metricVec
+	fn  func() float64
+}
+
+// NewGaugeFunc registers a gauge which calls fn every time it is scraped
+func (r *MetricsRegistry) NewGaugeFunc(name string, help string, fn func() float64) {
+	r.register(&valueFunc{newMetricVec(name, help, "gauge", nil), fn})
+}
+
+// NewCounterFunc registers a counter which calls fn every time it is scraped,
+// fn must never decrease
+func (r *MetricsRegistry) NewCounterFunc(name string, help string, fn func() float64) {
+	r.register(&valueFunc{newMetricVec(name, help, "counter", nil), fn})
+}
+
+func (f *valueFunc) write(w io.Writer) {
+	f.vec.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", f.vec.name, formatMetricValue(f.fn()))
+}
+
+type Histogram struct {
+	vec     *metricVec
+	buckets []float64
+}
+
+func (r *MetricsRegistry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newMetricVec(name, help, "histogram", labels), buckets}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.vec.mu.Lock()
+	defer h.vec.mu.Unlock()
+
+	s := h.vec.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.value++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.vec.mu.Lock()
+	defer h.vec.mu.Unlock()
+
+	h.vec.writeHeader(w)
+	for _, s := range h.vec.sortedSeries() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.vec.name, formatLabels(h.vec.labels, s.labelValues, "le", formatMetricValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", h.vec.name, formatLabels(h.vec.labels, s.labelValues, "le", "+Inf"), formatMetricValue(s.value))
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.vec.name, formatLabels(h.vec.labels, s.labelValues, "", ""), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", h.vec.name, formatLabels(h.vec.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+	}
+}
+
+// formatLabels renders a label set, with an optional extra label at the end
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, labelEscaper.Replace(extraValue)))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
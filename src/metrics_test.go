@@ -0,0 +1,170 @@
+package src
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func renderMetrics(r *MetricsRegistry) string {
+	var buf bytes.Buffer
+	r.Render(&buf)
+	return buf.String()
+}
+
+func TestMetricsTextFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(r *MetricsRegistry)
+		expected string
+	}{
+		{
+			name: "counter without labels",
+			register: func(r *MetricsRegistry) {
+				c := r.NewCounter("files_total", "Files processed.")
+				c.Inc()
+				c.Add(2.5)
+			},
+			expected: `# HELP files_total Files processed.
+# TYPE files_total counter
+files_total 3.5
+`,
+		},
+		{
+			name: "counter series are sorted by label values",
+			register: func(r *MetricsRegistry) {
+				c := r.NewCounter("requests_total", "Requests.", "method", "status")
+				c.Inc("POST", "500")
+				c.Inc("GET", "200")
+				c.Inc("GET", "200")
+			},
+			expected: `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 2
+requests_total{method="POST",status="500"} 1
+`,
+		},
+		{
+			name: "label values and help are escaped",
+			register: func(r *MetricsRegistry) {
+				g := r.NewGauge("escaped", "Help with a \\ backslash,\na newline and \"quotes\".", "path")
+				g.Set(1, "C:\\replays\\\"new\"\nline")
+			},
+			expected: `# HELP escaped Help with a \\ backslash,\na newline and "quotes".
+# TYPE escaped gauge
+escaped{path="C:\\replays\\\"new\"\nline"} 1
+`,
+		},
+		{
+			name: "special values",
+			register: func(r *MetricsRegistry) {
+				g := r.NewGauge("special", "Special values.", "kind")
+				g.Set(math.Inf(1), "a")
+				g.Set(math.Inf(-1), "b")
+				g.Set(math.NaN(), "c")
+				g.Set(1e-7, "d")
+			},
+			expected: `# HELP special Special values.
+# TYPE special gauge
+special{kind="a"} +Inf
+special{kind="b"} -Inf
+special{kind="c"} NaN
+special{kind="d"} 1e-07
+`,
+		},
+		{
+			name: "functions are called when rendering",
+			register: func(r *MetricsRegistry) {
+				r.NewGaugeFunc("queue_length", "Queued files.", func() float64 { return 7 })
+				r.NewCounterFunc("uptime_seconds_total", "Uptime.", func() float64 { return 12.5 })
+			},
+			expected: `# HELP queue_length Queued files.
+# TYPE queue_length gauge
+queue_length 7
+# HELP uptime_seconds_total Uptime.
+# TYPE uptime_seconds_total counter
+uptime_seconds_total 12.5
+`,
+		},
+		{
+			name: "histogram buckets are cumulative",
+			register: func(r *MetricsRegistry) {
+				h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 0.5, 1}, "route")
+				h.Observe(0.05, "/api")
+				h.Observe(0.1, "/api")
+				h.Observe(0.7, "/api")
+				h.Observe(3, "/api")
+			},
+			expected: `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/api",le="0.1"} 2
+latency_seconds_bucket{route="/api",le="0.5"} 2
+latency_seconds_bucket{route="/api",le="1"} 3
+latency_seconds_bucket{route="/api",le="+Inf"} 4
+latency_seconds_sum{route="/api"} 3.85
+latency_seconds_count{route="/api"} 4
+`,
+		},
+		{
+			name: "histogram without labels",
+			register: func(r *MetricsRegistry) {
+				h := r.NewHistogram("stage_seconds", "Stage time.", []float64{1})
+				h.Observe(2)
+			},
+			expected: `# HELP stage_seconds Stage time.
+# TYPE stage_seconds histogram
+stage_seconds_bucket{le="1"} 0
+stage_seconds_bucket{le="+Inf"} 1
+stage_seconds_sum 2
+stage_seconds_count 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewMetricsRegistry()
+			tt.register(r)
+			if out := renderMetrics(r); out != tt.expected {
+				t.Errorf("unexpected output\ngot:\n%s\nexpected:\n%s", out, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMetricsRenderInRegistrationOrder(t *testing.T) {
+	r := NewMetricsRegistry()
+	r.NewCounter("b_total", "B.").Inc()
+	r.NewCounter("a_total", "A.").Inc()
+
+	out := renderMetrics(r)
+	if strings.Index(out, "b_total") > strings.Index(out, "a_total") {
+		t.Errorf("expected b_total before a_total:\n%s", out)
+	}
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	r := NewMetricsRegistry()
+	r.NewCounter("files_total", "Files processed.").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	if body := w.Body.String(); body != renderMetrics(r) {
+		t.Errorf("unexpected body:\n%s", body)
+	}
+}
+
+func TestMetricsWrongLabelCountPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	r := NewMetricsRegistry()
+	r.NewCounter("requests_total", "Requests.", "method").Inc()
+}
@@ -1,5 +1,38 @@
 package src
 
+import "time"
+
+type Game struct {
+	GameID      int64
+	Filename    string
+	TS          time.Time
+	Loops       int64
+	DurationSec float64
+	MapName     string
+	GameVersion string
+	Matchup     string
+}
+
+type Player struct {
+	GameID   int64
+	PlayerID int
+	// TeamID is the player's team in the lobby, players in a free for all
+	// are each on their own team
+	TeamID int
+
+	RegionID int64
+	RealmID  int64
+	ToonID   int64
+
+	Name         string
+	Race         string
+	OpponentRace string
+
+	MMR    float64
+	APM    float64
+	Result string
+}
+
 type PlayerStats struct {
 	GameID   int64
 	PlayerID int
@@ -11,6 +44,110 @@ type PlayerStats struct {
 	MineralsCurrent        int
 	VespeneCollectionRate  int
 	VespeneCurrent         int
+
+	WorkersActiveCount               int
+	MineralsUsedInProgressArmy       int
+	MineralsUsedInProgressEconomy    int
+	MineralsUsedInProgressTechnology int
+	VespeneUsedInProgressArmy        int
+	VespeneUsedInProgressEconomy     int
+	VespeneUsedInProgressTechnology  int
+	MineralsUsedCurrentArmy          int
+	MineralsUsedCurrentEconomy       int
+	MineralsUsedCurrentTechnology    int
+	VespeneUsedCurrentArmy           int
+	VespeneUsedCurrentEconomy        int
+	VespeneUsedCurrentTechnology     int
+	MineralsLostArmy                 int
+	MineralsLostEconomy              int
+	MineralsLostTechnology           int
+	VespeneLostArmy                  int
+	VespeneLostEconomy               int
+	VespeneLostTechnology            int
+	MineralsKilledArmy               int
+	MineralsKilledEconomy            int
+	MineralsKilledTechnology         int
+	VespeneKilledArmy                int
+	VespeneKilledEconomy             int
+	VespeneKilledTechnology          int
+	MineralsUsedActiveForces         int
+	VespeneUsedActiveForces          int
+	MineralsFriendlyFireArmy         int
+	MineralsFriendlyFireEconomy      int
+	MineralsFriendlyFireTechnology   int
+	VespeneFriendlyFireArmy          int
+	VespeneFriendlyFireEconomy       int
+	VespeneFriendlyFireTechnology    int
+}
+
+// GameEvent is something a player did, rather than its outcome, see the
+// GameEvtID constants
+// Only the fields relevant to EventType are set. Abilities are identified by
+// their AbilityLink and AbilityCmdIndex, which depend on the game version.
+type GameEvent struct {
+	GameID   int64
+	PlayerID int
+	LoopID   int64
+
+	EventType string
+
+	AbilityLink     *int
+	AbilityCmdIndex *int
+	CmdFlags        *int
+
+	// TargetX and TargetY are in map cells, for cmd and updateTarget events
+	// with a target, and camera events
+	TargetX *float64
+	TargetY *float64
+	// TargetUnitTag is the UnitTag of the target of a cmd or updateTarget
+	// event, and TargetUnitType its type if it was seen in the tracker events
+	TargetUnitTag  *int64
+	TargetUnitType *string
+
+	// ControlGroup is the control group of selection and controlGroup events,
+	// 10 is the active selection
+	ControlGroup *int
+	// ControlGroupAction is 0 to set, 1 to append, 2 to recall and 3 to clear
+	// a control group
+	ControlGroupAction *int
+	// UnitsAdded is the number of units added to a selection
+	UnitsAdded *int
+}
+
+// UnitEvent records where a unit was born, started construction or died
+// X and Y are in map cells. The killer is only set on died events, and not
+// even then for units which were cancelled or killed by the map.
+type UnitEvent struct {
+	GameID   int64
+	UnitTag  int64
+	LoopID   int64
+	PlayerID int
+
+	Kind      string
+	EventType string
+	X         int
+	Y         int
+
+	KillerPlayerID *int
+	KillerUnitTag  *int64
+	KillerKind     *string
+}
+
+// EngagementPlayer is one player's part in an engagement, see Engagement
+type EngagementPlayer struct {
+	GameID       int64
+	EngagementID int
+	PlayerID     int
+
+	StartLoop int64
+	EndLoop   int64
+	X         float64
+	Y         float64
+
+	UnitsLost    int
+	UnitsKilled  int
+	MineralsLost int
+	VespeneLost  int
 }
 
 type BuildCompChange struct {
@@ -0,0 +1,376 @@
+package src
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// LoopsPerSecond is the number of game loops in one second of game time
+const LoopsPerSecond = 16
+
+var ErrPlaybackNotFound = errors.New("playback not found")
+
+// PlaybackState describes where a playback is and how fast it is moving
+type PlaybackState struct {
+	ID        string  `json:"id"`
+	GameID    int64   `json:"gameid"`
+	LoopID    int64   `json:"loop"`
+	MaxLoopID int64   `json:"maxLoop"`
+	Speed     float64 `json:"speed"`
+	Paused    bool    `json:"paused"`
+	Finished  bool    `json:"finished"`
+}
+
+// PlaybackFrame contains every event and stats row which happened between
+// the previous frame and LoopID
+type PlaybackFrame struct {
+	LoopID int64   `json:"loop"`
+	Events []Event `json:"events"`
+	Stats  []Stats `json:"stats"`
+}
+
+// PlaybackSeek is sent after the cursor jumps to a new position
+// Since the frames between the old and the new position are never sent, it
+// contains each player's composition at the new position.
+type PlaybackSeek struct {
+	LoopID       int64               `json:"loop"`
+	Compositions map[int]Composition `json:"compositions"`
+}
+
+// PlaybackMessage is delivered to every subscriber of a playback
+// Name is one of "state", "frame" or "seek" and Data holds the matching type.
+type PlaybackMessage struct {
+	Name string
+	Data interface{}
+}
+
+// Playback replays a stored game's timeline in real time as if it were being
+// played live
+type Playback struct {
+	id       string
+	timeline *Timeline
+
+	mu     sync.Mutex
+	loop   int64
+	speed  float64
+	paused bool
+
+	// index of the next event and stats row to emit
+	nextEvent int
+	nextStats int
+
+	// fractional loops carried between ticks when speed is not an integer
+	carry float64
+
+	subscribers map[chan PlaybackMessage]struct{}
+	lastActive  time.Time
+	closed      chan struct{}
+}
+
+func NewPlayback(timeline *Timeline, speed float64) *Playback {
+	if speed <= 0 {
+		speed = 1
+	}
+	return &Playback{
+		id:          uuid.NewV4().String(),
+		timeline:    timeline,
+		speed:       speed,
+		subscribers: make(map[chan PlaybackMessage]struct{}),
+		lastActive:  time.Now(),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (p *Playback) ID() string {
+	return p.id
+}
+
+func (p *Playback) GameID() int64 {
+	return p.timeline.GameID
+}
+
+func (p *Playback) Timeline() *Timeline {
+	return p.timeline
+}
+
+func (p *Playback) State() PlaybackState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stateLocked()
+}
+
+func (p *Playback) stateLocked() PlaybackState {
+	return PlaybackState{
+		ID:        p.id,
+		GameID:    p.timeline.GameID,
+		LoopID:    p.loop,
+		MaxLoopID: p.timeline.MaxLoopID(),
+		Speed:     p.speed,
+		Paused:    p.paused,
+		Finished:  p.loop >= p.timeline.MaxLoopID(),
+	}
+}
+
+// Subscribe returns a channel which receives every message published by the
+// playback, starting with the current state
+// The channel is closed if the subscriber falls too far behind or the
+// playback is closed. ErrPlaybackNotFound is returned if the playback was
+// closed before the call.
+func (p *Playback) Subscribe() (chan PlaybackMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closed:
+		return nil, ErrPlaybackNotFound
+	default:
+	}
+
+	ch := make(chan PlaybackMessage, 256)
+	ch <- PlaybackMessage{Name: "state", Data: p.stateLocked()}
+	p.subscribers[ch] = struct{}{}
+	p.lastActive = time.Now()
+	return ch, nil
+}
+
+func (p *Playback) Unsubscribe(ch chan PlaybackMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.subscribers[ch]; ok {
+		delete(p.subscribers, ch)
+		close(ch)
+	}
+	p.lastActive = time.Now()
+}
+
+func (p *Playback) publishLocked(name string, data interface{}) {
+	msg := PlaybackMessage{Name: name, Data: data}
+	for ch := range p.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			// drop subscribers which can't keep up rather than stalling the clock
+			delete(p.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (p *Playback) Pause() PlaybackState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.paused = true
+	state := p.stateLocked()
+	p.publishLocked("state", state)
+	return state
+}
+
+func (p *Playback) Resume() PlaybackState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.paused = false
+	state := p.stateLocked()
+	p.publishLocked("state", state)
+	return state
+}
+
+func (p *Playback) SetSpeed(speed float64) PlaybackState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if speed > 0 {
+		p.speed = speed
+	}
+	state := p.stateLocked()
+	p.publishLocked("state", state)
+	return state
+}
+
+// SeekLoop moves the cursor to loop, in either direction
+func (p *Playback) SeekLoop(loop int64) PlaybackState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if loop < 0 {
+		loop = 0
+	}
+	if maxLoop := p.timeline.MaxLoopID(); loop > maxLoop {
+		loop = maxLoop
+	}
+
+	events, stats := p.timeline.Events, p.timeline.Stats
+	p.loop = loop
+	p.carry = 0
+	p.nextEvent = sort.Search(len(events), func(i int) bool { return events[i].LoopID > loop })
+	p.nextStats = sort.Search(len(stats), func(i int) bool { return stats[i].LoopID > loop })
+
+	compositions := p.timeline.Compositions(0, loop)
+	p.publishLocked("seek", PlaybackSeek{LoopID: loop, Compositions: compositions})
+
+	state := p.stateLocked()
+	p.publishLocked("state", state)
+	return state
+}
+
+// tick advances the clock by one tick worth of loops and publishes a frame
+// if anything happened
+func (p *Playback) tick() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxLoop := p.timeline.MaxLoopID()
+	if p.paused || p.loop >= maxLoop {
+		return
+	}
+
+	p.carry += p.speed
+	advance := int64(p.carry)
+	if advance == 0 {
+		return
+	}
+	p.carry -= float64(advance)
+
+	p.loop += advance
+	if p.loop > maxLoop {
+		p.loop = maxLoop
+	}
+
+	frame := PlaybackFrame{LoopID: p.loop, Events: make([]Event, 0), Stats: make([]Stats, 0)}
+	events, stats := p.timeline.Events, p.timeline.Stats
+	for p.nextEvent < len(events) && events[p.nextEvent].LoopID <= p.loop {
+		frame.Events = append(frame.Events, events[p.nextEvent])
+		p.nextEvent++
+	}
+	for p.nextStats < len(stats) && stats[p.nextStats].LoopID <= p.loop {
+		frame.Stats = append(frame.Stats, stats[p.nextStats])
+		p.nextStats++
+	}
+
+	if len(frame.Events) > 0 || len(frame.Stats) > 0 {
+		p.publishLocked("frame", frame)
+	}
+	if p.loop >= maxLoop {
+		p.publishLocked("state", p.stateLocked())
+	}
+}
+
+// run drives the playback clock, one tick per game loop
+func (p *Playback) run() {
+	ticker := time.NewTicker(LoopTime(1))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.tick()
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *Playback) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	close(p.closed)
+	for ch := range p.subscribers {
+		delete(p.subscribers, ch)
+		close(ch)
+	}
+}
+
+// idleSince returns the time the last subscriber left, or the zero time if
+// the playback has subscribers
+func (p *Playback) idleSince() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.subscribers) > 0 {
+		return time.Time{}
+	}
+	return p.lastActive
+}
+
+// PlaybackManager keeps track of every running playback
+// Playbacks without any subscribers are stopped after IdleTimeout.
+type PlaybackManager struct {
+	IdleTimeout time.Duration
+
+	mu        sync.Mutex
+	playbacks map[string]*Playback
+}
+
+func NewPlaybackManager(idleTimeout time.Duration) *PlaybackManager {
+	m := &PlaybackManager{
+		IdleTimeout: idleTimeout,
+		playbacks:   make(map[string]*Playback),
+	}
+	go m.reap()
+	return m
+}
+
+// Start begins playing back a timeline from the first loop
+func (m *PlaybackManager) Start(timeline *Timeline, speed float64) *Playback {
+	p := NewPlayback(timeline, speed)
+
+	m.mu.Lock()
+	m.playbacks[p.ID()] = p
+	m.mu.Unlock()
+
+	go p.run()
+	return p
+}
+
+func (m *PlaybackManager) Get(id string) (*Playback, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.playbacks[id]
+	if !ok {
+		return nil, ErrPlaybackNotFound
+	}
+	return p, nil
+}
+
+func (m *PlaybackManager) Stop(id string) error {
+	m.mu.Lock()
+	p, ok := m.playbacks[id]
+	delete(m.playbacks, id)
+	m.mu.Unlock()
+
+	if !ok {
+		return ErrPlaybackNotFound
+	}
+	p.close()
+	return nil
+}
+
+func (m *PlaybackManager) reap() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		idle := make([]string, 0)
+
+		m.mu.Lock()
+		for id, p := range m.playbacks {
+			since := p.idleSince()
+			if !since.IsZero() && time.Since(since) > m.IdleTimeout {
+				idle = append(idle, id)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, id := range idle {
+			m.Stop(id)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package src
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key the request ID is stored under
+const requestIDKey = "requestID"
+
+type MetricsConfig struct {
+	// Enabled serves Prometheus metrics on /metrics
+	Enabled bool
+	// SlowRequestMs logs every request which takes longer than this, disabled
+	// when 0
+	SlowRequestMs int
+}
+
+// PlayerMetrics records the latency of the player API and the store queries
+// behind it
+// All methods may be called on a nil *PlayerMetrics, in which case they do
+// nothing.
+type PlayerMetrics struct {
+	Registry *MetricsRegistry
+
+	slowRequest time.Duration
+
+	requests        *Counter
+	requestErrors   *Counter
+	requestDuration *Histogram
+	queryDuration   *Histogram
+	queryErrors     *Counter
+	searchDuration  *Histogram
+}
+
+func NewPlayerMetrics(config MetricsConfig) *PlayerMetrics {
+	r := NewMetricsRegistry()
+	return &PlayerMetrics{
+		Registry:    r,
+		slowRequest: time.Duration(config.SlowRequestMs) * time.Millisecond,
+
+		requests:        r.NewCounter("player_http_requests_total", "HTTP requests by route and status.", "method", "route", "status"),
+		requestErrors:   r.NewCounter("player_http_request_errors_total", "HTTP requests which returned a 5xx status.", "method", "route"),
+		requestDuration: r.NewHistogram("player_http_request_duration_seconds", "HTTP request latency by route, excluding event streams.", DefaultLatencyBuckets, "method", "route"),
+		queryDuration:   r.NewHistogram("player_store_query_duration_seconds", "Store query latency by method.", DefaultLatencyBuckets, "method"),
+		queryErrors:     r.NewCounter("player_store_query_errors_total", "Store queries which returned an error.", "method"),
+		searchDuration:  r.NewHistogram("player_similar_search_duration_seconds", "Similar game point search latency by engine.", DefaultLatencyBuckets, "engine"),
+	}
+}
+
+// Middleware records the latency and status of every request and tags it
+// with a request ID, taken from the X-Request-ID header when the client
+// provides one
+func (m *PlayerMetrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header(requestIDHeader, requestID)
+
+		start := time.Now()
+		c.Next()
+		elapsed := time.Since(start)
+
+		if m == nil {
+			return
+		}
+
+		// use the route pattern rather than the path to bound the number of
+		// series
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		status := c.Writer.Status()
+
+		m.requests.Inc(method, route, strconv.Itoa(status))
+		if status >= 500 {
+			m.requestErrors.Inc(method, route)
+		}
+
+		// event streams stay open as long as the client is watching
+		if strings.HasSuffix(route, "/stream") {
+			return
+		}
+		m.requestDuration.Observe(elapsed.Seconds(), method, route)
+
+		if m.slowRequest > 0 && elapsed > m.slowRequest {
+			log.Printf("slow request %s: %s %s took %s (status %d)", requestID, method, c.Request.URL.RequestURI(), elapsed.Round(time.Millisecond), status)
+		}
+	}
+}
+
+// RequestLogger is gin's access log with the request ID of each request
+// appended, it must be registered before Middleware
+func RequestLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		requestID, _ := param.Keys[requestIDKey].(string)
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v | %s\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			param.StatusCode,
+			param.Latency,
+			param.ClientIP,
+			param.Method,
+			param.Path,
+			requestID,
+			param.ErrorMessage,
+		)
+	})
+}
+
+// errorResponse is the body of an error response, the request ID lets it be
+// matched up with the access log
+func errorResponse(c *gin.Context, msg string) gin.H {
+	return gin.H{"error": msg, "requestid": c.GetString(requestIDKey)}
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (m *PlayerMetrics) observeQuery(method string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.queryDuration.Observe(time.Since(start).Seconds(), method)
+	if err != nil {
+		m.queryErrors.Inc(method)
+	}
+}
+
+func (m *PlayerMetrics) observeSearch(engine string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.searchDuration.Observe(time.Since(start).Seconds(), engine)
+}
+
+// RegisterDBStats exposes the connection pool statistics of db
+func (m *PlayerMetrics) RegisterDBStats(db *sqlx.DB) {
+	r := m.Registry
+	r.NewGaugeFunc("player_db_open_connections", "Open connections to the database, in use or idle.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	r.NewGaugeFunc("player_db_in_use_connections", "Connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	r.NewGaugeFunc("player_db_idle_connections", "Idle connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	r.NewCounterFunc("player_db_wait_total", "Connections waited for because the pool was exhausted.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	r.NewCounterFunc("player_db_wait_seconds_total", "Time spent waiting for a connection.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	r.NewCounterFunc("player_db_closed_max_idle_total", "Connections closed because of the idle connection limit.", func() float64 {
+		return float64(db.Stats().MaxIdleClosed)
+	})
+	r.NewCounterFunc("player_db_closed_max_lifetime_total", "Connections closed because they reached their max lifetime.", func() float64 {
+		return float64(db.Stats().MaxLifetimeClosed)
+	})
+}
+
+// RegisterVectorIndex exposes the size of the index
+func (m *PlayerMetrics) RegisterVectorIndex(index *VectorIndex) {
+	m.Registry.NewGaugeFunc("player_vector_index_games", "Games in the in-process vector index.", func() float64 {
+		games, _ := index.Size()
+		return float64(games)
+	})
+	m.Registry.NewGaugeFunc("player_vector_index_vectors", "Vectors in the in-process vector index.", func() float64 {
+		_, vectors := index.Size()
+		return float64(vectors)
+	})
+}
+
+// InstrumentStore wraps a store so the duration of every query is recorded
+func InstrumentStore(store Store, metrics *PlayerMetrics) Store {
+	return &instrumentedStore{Store: store, metrics: metrics}
+}
+
+type instrumentedStore struct {
+	Store
+	metrics *PlayerMetrics
+}
+
+func (s *instrumentedStore) GameAlreadyLoaded(gameID int64) (bool, error) {
+	start := time.Now()
+	out, err := s.Store.GameAlreadyLoaded(gameID)
+	s.metrics.observeQuery("GameAlreadyLoaded", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) ListReplays(filter ReplayFilter) ([]ReplayMeta, error) {
+	start := time.Now()
+	out, err := s.Store.ListReplays(filter)
+	s.metrics.observeQuery("ListReplays", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) GetReplay(gameID int64) (*ReplayMeta, error) {
+	start := time.Now()
+	out, err := s.Store.GetReplay(gameID)
+	s.metrics.observeQuery("GetReplay", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) KindIcon(kind string) (string, error) {
+	start := time.Now()
+	out, err := s.Store.KindIcon(kind)
+	s.metrics.observeQuery("KindIcon", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadKindCatalog() ([]KindInfo, error) {
+	start := time.Now()
+	out, err := s.Store.LoadKindCatalog()
+	s.metrics.observeQuery("LoadKindCatalog", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadTimeline(gameID int64) (*Timeline, error) {
+	start := time.Now()
+	out, err := s.Store.LoadTimeline(gameID)
+	s.metrics.observeQuery("LoadTimeline", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadTimelinePage(gameID int64, filter TimelineFilter) (*TimelinePage, error) {
+	start := time.Now()
+	out, err := s.Store.LoadTimelinePage(gameID, filter)
+	s.metrics.observeQuery("LoadTimelinePage", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadUnitEvents(gameID int64, filter UnitEventFilter) (*UnitEvents, error) {
+	start := time.Now()
+	out, err := s.Store.LoadUnitEvents(gameID, filter)
+	s.metrics.observeQuery("LoadUnitEvents", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadEngagements(gameID int64) (*GameEngagements, error) {
+	start := time.Now()
+	out, err := s.Store.LoadEngagements(gameID)
+	s.metrics.observeQuery("LoadEngagements", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadEvents(gameID int64, filter TimelineFilter) ([]Event, error) {
+	start := time.Now()
+	out, err := s.Store.LoadEvents(gameID, filter)
+	s.metrics.observeQuery("LoadEvents", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadComposition(gameID int64, playerID int, minLoop int64, maxLoop int64) (Composition, error) {
+	start := time.Now()
+	out, err := s.Store.LoadComposition(gameID, playerID, minLoop, maxLoop)
+	s.metrics.observeQuery("LoadComposition", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadKindRegistry() (*KindRegistry, error) {
+	start := time.Now()
+	out, err := s.Store.LoadKindRegistry()
+	s.metrics.observeQuery("LoadKindRegistry", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadKindWeights(scheme string) (KindWeights, error) {
+	start := time.Now()
+	out, err := s.Store.LoadKindWeights(scheme)
+	s.metrics.observeQuery("LoadKindWeights", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadSimilarQuery(gameID int64, playerID int) (*SimilarQuery, error) {
+	start := time.Now()
+	out, err := s.Store.LoadSimilarQuery(gameID, playerID)
+	s.metrics.observeQuery("LoadSimilarQuery", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) CompareCompositions(a CompositionRef, b CompositionRef, lag int64) ([]KindComparison, error) {
+	start := time.Now()
+	out, err := s.Store.CompareCompositions(a, b, lag)
+	s.metrics.observeQuery("CompareCompositions", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) SimilarGamePoints(kinds *KindRegistry, query *SimilarQuery, comp Composition) ([]SimilarGamePoint, error) {
+	start := time.Now()
+	out, err := s.Store.SimilarGamePoints(kinds, query, comp)
+	s.metrics.observeQuery("SimilarGamePoints", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) ListLoadedGames() ([]LoadedGame, error) {
+	start := time.Now()
+	out, err := s.Store.ListLoadedGames()
+	s.metrics.observeQuery("ListLoadedGames", start, err)
+	return out, err
+}
+
+func (s *instrumentedStore) LoadCompvecs(gameIDs []int64) ([]Compvec, error) {
+	start := time.Now()
+	out, err := s.Store.LoadCompvecs(gameIDs)
+	s.metrics.observeQuery("LoadCompvecs", start, err)
+	return out, err
+}
@@ -0,0 +1,120 @@
+package src
+
+import (
+	"fmt"
+	"sync"
+)
+
+type PostprocessConfig struct {
+	// Concurrency is the number of chunks of compvecs computed at once, each
+	// on its own connection, defaults to 4
+	Concurrency int
+	// ChunkLoops is the number of loops covered by each chunk, defaults to
+	// 4800 (~5 minutes of game time)
+	ChunkLoops int
+}
+
+func (c PostprocessConfig) concurrency() int {
+	if c.Concurrency <= 0 {
+		return 4
+	}
+	return c.Concurrency
+}
+
+// chunkLoops rounds ChunkLoops up to a multiple of CompvecLoopInterval
+func (c PostprocessConfig) chunkLoops() int64 {
+	loops := int64(c.ChunkLoops)
+	if loops <= 0 {
+		loops = 4800
+	}
+	return (loops + CompvecLoopInterval - 1) / CompvecLoopInterval * CompvecLoopInterval
+}
+
+// PostprocessProgress is called each time a chunk of compvecs is finished,
+// including chunks which were finished by an earlier interrupted postprocess
+// The memory backend reports each game as a chunk.
+type PostprocessProgress func(done int, total int)
+
+// CompvecChunk is the compvecs of every game for one lag, at each loop in
+// [FromLoop, ToLoop]
+type CompvecChunk struct {
+	Lag      int64 `db:"looplag"`
+	FromLoop int64 `db:"fromLoop"`
+	ToLoop   int64 `db:"toLoop"`
+}
+
+func (c CompvecChunk) String() string {
+	return fmt.Sprintf("lag %d loops %d-%d", c.Lag, c.FromLoop, c.ToLoop)
+}
+
+// PlanCompvecChunks splits the compvecs of games up to maxLoop into chunks
+// which can be computed independently
+func PlanCompvecChunks(maxLoop int64, config PostprocessConfig) []CompvecChunk {
+	chunkLoops := config.chunkLoops()
+
+	out := make([]CompvecChunk, 0)
+	for _, lag := range CompvecLags {
+		for from := int64(CompvecLoopInterval); from <= maxLoop; from += chunkLoops {
+			to := from + chunkLoops - CompvecLoopInterval
+			if to > maxLoop {
+				to = maxLoop
+			}
+			out = append(out, CompvecChunk{Lag: lag, FromLoop: from, ToLoop: to})
+		}
+	}
+	return out
+}
+
+// runCompvecChunks calls prepare for each chunk on config.Concurrency
+// goroutines, and stops handing out chunks after the first error
+func runCompvecChunks(chunks []CompvecChunk, config PostprocessConfig, alreadyDone int, progress PostprocessProgress, prepare func(CompvecChunk) error) error {
+	total := alreadyDone + len(chunks)
+	done := alreadyDone
+	if progress != nil {
+		progress(done, total)
+	}
+
+	queue := make(chan CompvecChunk)
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	mu := sync.Mutex{}
+	var firstErr error
+
+	for i := 0; i < config.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range queue {
+				err := prepare(chunk)
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("compvecs for %s failed: %w", chunk, err)
+						close(stop)
+					}
+				} else {
+					done++
+					if progress != nil {
+						progress(done, total)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for _, chunk := range chunks {
+		select {
+		case queue <- chunk:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return firstErr
+}
@@ -2,15 +2,14 @@ package src
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/binary"
 	"fmt"
 	"html"
 	"log"
+	"runtime/debug"
 	"strings"
 	"time"
 
-	sq "github.com/Masterminds/squirrel"
 	"github.com/icza/s2prot"
 	"github.com/icza/s2prot/rep"
 )
@@ -43,136 +42,153 @@ type UnitInfo struct {
 	Alive    bool
 }
 
+// logUnknownUnit is called for events which refer to a unit we never saw
+// being born or initialized, which happens in some corrupt replays
+func logUnknownUnit(env *ProcessorEnv, evt s2prot.Event, tag int64) {
+	if env.Verbose >= VerboseDebug {
+		log.Printf("ignoring %s event for unknown unit (%d) at loop %d", evt.Name, tag, evt.Loop())
+	}
+}
+
 func gameIDFromFileName(fileName string) int64 {
 	data := sha256.Sum256([]byte(fileName))
 	return int64(binary.BigEndian.Uint64(data[:8]))
 }
 
-func GameAlreadyLoaded(db sq.BaseRunner, gameid int64) bool {
-	row := sq.
-		Select("1").
-		From("games").
-		Where(sq.Eq{"gameid": gameid, "loaded": true}).
-		RunWith(db).
-		QueryRow()
-
-	var out string
-	return row.Scan(&out) != sql.ErrNoRows
+// ReplayGameID returns the game ID Run assigns to a replay
+// It only depends on the path relative to replayDir, so it is the same on
+// every machine.
+func ReplayGameID(replayDir string, filename string) int64 {
+	return gameIDFromFileName(strings.TrimPrefix(filename, replayDir+"/"))
 }
 
-func DeleteGame(db sq.BaseRunner, gameid int64) error {
-	_, err := db.Exec("call deleteGame(?)", gameid)
-	return err
-}
+// Run loads a single replay
+// Errors are returned as a *RunError recording the stage which failed.
+func Run(env *ProcessorEnv, filename string) (err error) {
+	cleanFilename := strings.TrimPrefix(filename, env.ReplayDir+"/")
+	gameID := ReplayGameID(env.ReplayDir, filename)
 
-func MarkGameLoaded(db sq.BaseRunner, gameid int64) error {
-	res, err := db.Exec("update games set loaded = true where gameid = ?", gameid)
-	if err != nil {
-		return err
-	}
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return err
-	}
-	if rowsAffected != 1 {
-		return fmt.Errorf("failed to mark game %d as loaded", gameid)
+	stageErr := func(stage string, err error) error {
+		if err == nil {
+			return nil
+		}
+		return &RunError{Stage: stage, GameID: gameID, Err: err}
 	}
-	return nil
-}
 
-func Run(env *ProcessorEnv, filename string) error {
-	cleanFilename := strings.TrimPrefix(filename, env.ReplayDir+"/")
-	gameID := gameIDFromFileName(cleanFilename)
+	// s2prot panics on some malformed replays rather than returning an error
+	// the stack is kept so that panics in our own code can be told apart
+	defer func() {
+		if r := recover(); r != nil {
+			stack := string(debug.Stack())
+			log.Printf("panic while loading %s: %v\n%s", filename, r, stack)
+			err = &RunError{Stage: StagePanic, GameID: gameID, Err: fmt.Errorf("panic: %v", r), Stack: stack}
+		}
+	}()
 
-	if GameAlreadyLoaded(env.DB, gameID) {
-		log.Printf("SKIP: game already loaded: %s", filename)
-		return nil
+	// time each stage, the stage we return from is recorded by the defer
+	stage := StageCheck
+	stageStart := time.Now()
+	nextStage := func(next string) {
+		env.Stats.ObserveStage(stage, time.Since(stageStart))
+		stage, stageStart = next, time.Now()
 	}
+	defer func() {
+		env.Stats.ObserveStage(stage, time.Since(stageStart))
+	}()
 
-	err := DeleteGame(env.DB, gameID)
+	loaded, err := env.Store.GameAlreadyLoaded(gameID)
 	if err != nil {
-		return err
+		return stageErr(StageCheck, err)
+	}
+	if loaded {
+		log.Printf("SKIP: game already loaded: %s", filename)
+		env.Stats.Skipped(SkipAlreadyLoaded)
+		return nil
 	}
 
+	nextStage(StageParse)
 	replay, err := rep.NewFromFile(filename)
 	if err != nil {
-		return err
+		return stageErr(StageParse, err)
 	}
 
-	if len(replay.Details.Players()) != 2 || len(replay.Metadata.Players()) != 2 {
-		log.Printf("SKIP: found more than 2 players in replay: %s", filename)
+	if len(replay.Details.Players()) < 2 {
+		log.Printf("SKIP: found fewer than 2 players in replay: %s", filename)
+		env.Stats.Skipped(SkipPlayers)
 		return nil
 	}
-	if replay.Header.Loops() >= 57600 {
-		log.Printf("SKIP: replay longer than 1 hour (57600 loops): %s", filename)
+	if env.MaxLoops > 0 && replay.Header.Loops() >= env.MaxLoops {
+		log.Printf("SKIP: replay longer than %d loops: %s", env.MaxLoops, filename)
+		env.Stats.Skipped(SkipTooLong)
 		return nil
 	}
 
-	_, err = sq.
-		Replace("games").
-		SetMap(map[string]interface{}{
-			"gameID":      gameID,
-			"filename":    cleanFilename,
-			"ts":          replay.Details.TimeUTC(),
-			"loops":       replay.Header.Loops(),
-			"durationSec": replay.Metadata.DurationSec(),
-			"mapName":     replay.Metadata.Title(),
-			"gameVersion": replay.Metadata.GameVersion(),
-			"matchup":     replay.Details.Matchup(),
-		}).
-		RunWith(env.DB).
-		Exec()
-	if err != nil {
-		return err
+	game := &Game{
+		GameID:      gameID,
+		Filename:    cleanFilename,
+		TS:          replay.Details.TimeUTC(),
+		Loops:       replay.Header.Loops(),
+		DurationSec: replay.Metadata.DurationSec(),
+		MapName:     replay.Metadata.Title(),
+		GameVersion: replay.Metadata.GameVersion(),
+	}
+	// replays from before patch 3.0 don't have any metadata
+	if game.MapName == "" {
+		game.MapName = replay.Details.Title()
+	}
+	if game.GameVersion == "" {
+		game.GameVersion = replay.Header.VersionString()
+	}
+	if game.DurationSec == 0 {
+		game.DurationSec = replay.Header.Duration().Seconds()
 	}
 
-	query := sq.Replace("players").RunWith(env.DB).Columns(
-		"gameID", "playerID", "regionID", "realmID", "toonID", "name", "race", "opponentRace", "mmr", "apm", "result",
-	)
+	teamIDs := replayTeamIDs(replay)
+	metaPlayers := replayMetaPlayers(replay)
 
+	players := make([]Player, 0, len(teamIDs))
 	for i, player := range replay.Details.Players() {
-		playerID := i + 1
-
-		// we checked earlier that there were exactly 2 players and that both
-		// player arrays are the same length
-		metaPlayer := replay.Metadata.Players()[i]
-		opponent := replay.Details.Players()[(i+1)%2]
-
-		query = query.Values(
-			gameID,
-			playerID,
-			player.Toon.RegionID(),
-			player.Toon.RealmID(),
-			player.Toon.ID(),
-			html.UnescapeString(player.Name),
-			player.Race().Name,
-			opponent.Race().Name,
-			metaPlayer.MMR(),
-			metaPlayer.APM(),
-			player.Result().Name,
-		)
+		p := Player{
+			GameID:   gameID,
+			PlayerID: i + 1,
+			TeamID:   teamIDs[i],
+			RegionID: player.Toon.RegionID(),
+			RealmID:  player.Toon.RealmID(),
+			ToonID:   player.Toon.ID(),
+			Name:     html.UnescapeString(player.Name),
+			Race:     player.Race().Name,
+			Result:   player.Result().Name,
+		}
+		if metaPlayer, ok := metaPlayers[p.PlayerID]; ok {
+			p.MMR = metaPlayer.MMR()
+			p.APM = metaPlayer.APM()
+		}
+		players = append(players, p)
+	}
+	for i := range players {
+		players[i].OpponentRace = OpponentRace(players, &players[i])
 	}
+	game.Matchup = TeamMatchup(players)
 
-	_, err = query.Exec()
+	nextStage(StageLoad)
+
+	// nothing we write is visible until the loader is published, so any error
+	// below leaves the previous copy of the game (if any) untouched
+	loader, err := env.Store.NewGameLoader(game, players)
 	if err != nil {
-		return err
+		return stageErr(StageLoad, err)
 	}
-
-	statsLoader := NewLoader(env.DB, "playerstats", env.PlayerStatsSchema)
 	defer func() {
-		err := statsLoader.Close()
+		err := loader.Abort()
 		if err != nil {
-			log.Fatalf("PlayerStats Loader failed: %s", err)
+			log.Printf("unable to discard staged game %d: %s", gameID, err)
 		}
 	}()
 
-	buildCompLoader := NewLoader(env.DB, "buildcomp", env.BuildCompSchema)
-	defer func() {
-		err := buildCompLoader.Close()
-		if err != nil {
-			log.Fatalf("BuildComp Loader failed: %s", err)
-		}
-	}()
+	rows := map[string]int64{
+		TableGames:   1,
+		TablePlayers: int64(len(players)),
+	}
 
 	writeBuildCompChange := func(loop int64, playerID int, unitType string, num int) error {
 		// playerID 0 is used for map objects like mineral fields and so on
@@ -185,31 +201,92 @@ func Run(env *ProcessorEnv, filename string) error {
 			return nil
 		}
 
-		return buildCompLoader.Encode(&BuildCompChange{
+		rows[TableBuildComp]++
+		return stageErr(StageLoad, loader.WriteBuildComp(&BuildCompChange{
 			GameID:   gameID,
 			PlayerID: playerID,
 			LoopID:   loop,
 			Kind:     unitType,
 			Num:      num,
-		})
+		}))
+	}
+
+	// unlike buildcomp, unit events include map objects owned by player 0 so
+	// destroyed rocks and mined out minerals show up
+	writeUnitEvent := func(event *UnitEvent) error {
+		if IgnoreUnitTypeRe.MatchString(event.Kind) {
+			return nil
+		}
+
+		rows[TableUnitEvents]++
+		return stageErr(StageLoad, loader.WriteUnitEvent(event))
 	}
 
 	unitMap := make(map[int64]*UnitInfo)
 
+	// collected for DetectEngagements
+	deaths := make([]*UnitEvent, 0)
+	lost := make([]ResourcesLost, 0)
+
 	for _, evt := range replay.TrackerEvts.Evts {
 		switch evt.ID {
 		case TrackerEvtIDPlayerStats:
 			stats := evt.Structv("stats")
-			statsLoader.Encode(&PlayerStats{
-				GameID:                 gameID,
-				PlayerID:               int(evt.Int("playerId")),
-				LoopID:                 evt.Loop(),
-				FoodMade:               int(stats.Int("scoreValueFoodMade")),
-				FoodUsed:               int(stats.Int("scoreValueFoodUsed")),
-				MineralsCollectionRate: int(stats.Int("scoreValueMineralsCollectionRate")),
-				MineralsCurrent:        int(stats.Int("scoreValueMineralsCurrent")),
-				VespeneCollectionRate:  int(stats.Int("scoreValueVespeneCollectionRate")),
-				VespeneCurrent:         int(stats.Int("scoreValueVespeneCurrent")),
+			playerStats := &PlayerStats{
+				GameID:                           gameID,
+				PlayerID:                         int(evt.Int("playerId")),
+				LoopID:                           evt.Loop(),
+				FoodMade:                         int(stats.Int("scoreValueFoodMade")),
+				FoodUsed:                         int(stats.Int("scoreValueFoodUsed")),
+				MineralsCollectionRate:           int(stats.Int("scoreValueMineralsCollectionRate")),
+				MineralsCurrent:                  int(stats.Int("scoreValueMineralsCurrent")),
+				VespeneCollectionRate:            int(stats.Int("scoreValueVespeneCollectionRate")),
+				VespeneCurrent:                   int(stats.Int("scoreValueVespeneCurrent")),
+				WorkersActiveCount:               int(stats.Int("scoreValueWorkersActiveCount")),
+				MineralsUsedInProgressArmy:       int(stats.Int("scoreValueMineralsUsedInProgressArmy")),
+				MineralsUsedInProgressEconomy:    int(stats.Int("scoreValueMineralsUsedInProgressEconomy")),
+				MineralsUsedInProgressTechnology: int(stats.Int("scoreValueMineralsUsedInProgressTechnology")),
+				VespeneUsedInProgressArmy:        int(stats.Int("scoreValueVespeneUsedInProgressArmy")),
+				VespeneUsedInProgressEconomy:     int(stats.Int("scoreValueVespeneUsedInProgressEconomy")),
+				VespeneUsedInProgressTechnology:  int(stats.Int("scoreValueVespeneUsedInProgressTechnology")),
+				MineralsUsedCurrentArmy:          int(stats.Int("scoreValueMineralsUsedCurrentArmy")),
+				MineralsUsedCurrentEconomy:       int(stats.Int("scoreValueMineralsUsedCurrentEconomy")),
+				MineralsUsedCurrentTechnology:    int(stats.Int("scoreValueMineralsUsedCurrentTechnology")),
+				VespeneUsedCurrentArmy:           int(stats.Int("scoreValueVespeneUsedCurrentArmy")),
+				VespeneUsedCurrentEconomy:        int(stats.Int("scoreValueVespeneUsedCurrentEconomy")),
+				VespeneUsedCurrentTechnology:     int(stats.Int("scoreValueVespeneUsedCurrentTechnology")),
+				MineralsLostArmy:                 int(stats.Int("scoreValueMineralsLostArmy")),
+				MineralsLostEconomy:              int(stats.Int("scoreValueMineralsLostEconomy")),
+				MineralsLostTechnology:           int(stats.Int("scoreValueMineralsLostTechnology")),
+				VespeneLostArmy:                  int(stats.Int("scoreValueVespeneLostArmy")),
+				VespeneLostEconomy:               int(stats.Int("scoreValueVespeneLostEconomy")),
+				VespeneLostTechnology:            int(stats.Int("scoreValueVespeneLostTechnology")),
+				MineralsKilledArmy:               int(stats.Int("scoreValueMineralsKilledArmy")),
+				MineralsKilledEconomy:            int(stats.Int("scoreValueMineralsKilledEconomy")),
+				MineralsKilledTechnology:         int(stats.Int("scoreValueMineralsKilledTechnology")),
+				VespeneKilledArmy:                int(stats.Int("scoreValueVespeneKilledArmy")),
+				VespeneKilledEconomy:             int(stats.Int("scoreValueVespeneKilledEconomy")),
+				VespeneKilledTechnology:          int(stats.Int("scoreValueVespeneKilledTechnology")),
+				MineralsUsedActiveForces:         int(stats.Int("scoreValueMineralsUsedActiveForces")),
+				VespeneUsedActiveForces:          int(stats.Int("scoreValueVespeneUsedActiveForces")),
+				MineralsFriendlyFireArmy:         int(stats.Int("scoreValueMineralsFriendlyFireArmy")),
+				MineralsFriendlyFireEconomy:      int(stats.Int("scoreValueMineralsFriendlyFireEconomy")),
+				MineralsFriendlyFireTechnology:   int(stats.Int("scoreValueMineralsFriendlyFireTechnology")),
+				VespeneFriendlyFireArmy:          int(stats.Int("scoreValueVespeneFriendlyFireArmy")),
+				VespeneFriendlyFireEconomy:       int(stats.Int("scoreValueVespeneFriendlyFireEconomy")),
+				VespeneFriendlyFireTechnology:    int(stats.Int("scoreValueVespeneFriendlyFireTechnology")),
+			}
+			err := loader.WriteStats(playerStats)
+			if err != nil {
+				return stageErr(StageLoad, err)
+			}
+			rows[TablePlayerStats]++
+
+			lost = append(lost, ResourcesLost{
+				PlayerID: playerStats.PlayerID,
+				LoopID:   playerStats.LoopID,
+				Minerals: playerStats.MineralsLostArmy + playerStats.MineralsLostEconomy + playerStats.MineralsLostTechnology,
+				Vespene:  playerStats.VespeneLostArmy + playerStats.VespeneLostEconomy + playerStats.VespeneLostTechnology,
 			})
 		case TrackerEvtIDUnitBorn:
 			unitInfo := &UnitInfo{
@@ -223,13 +300,31 @@ func Run(env *ProcessorEnv, filename string) error {
 				log.Printf("player %d created %s (%d)", unitInfo.PlayerId, unitInfo.UnitType, UnitTag(evt))
 			}
 
-			err := writeBuildCompChange(evt.Loop(), unitInfo.PlayerId, unitInfo.UnitType, 1)
+			err := writeUnitEvent(newUnitEvent(evt, gameID, UnitEventBorn, unitInfo))
+			if err != nil {
+				return err
+			}
+
+			err = writeBuildCompChange(evt.Loop(), unitInfo.PlayerId, unitInfo.UnitType, 1)
 			if err != nil {
 				return err
 			}
 		case TrackerEvtIDUnitDied:
 			tag := UnitTag(evt)
-			unitInfo := unitMap[tag]
+			unitInfo, ok := unitMap[tag]
+			if !ok {
+				logUnknownUnit(env, evt, tag)
+				continue
+			}
+
+			// units which die before they are done, like cancelled buildings,
+			// are recorded too
+			died := newUnitDiedEvent(evt, gameID, unitInfo, unitMap)
+			deaths = append(deaths, died)
+			err := writeUnitEvent(died)
+			if err != nil {
+				return err
+			}
 
 			if unitInfo.Alive {
 				if env.Verbose >= VerboseSpam {
@@ -245,7 +340,11 @@ func Run(env *ProcessorEnv, filename string) error {
 		case TrackerEvtIDUnitOwnerChange:
 			loop := evt.Loop()
 			tag := UnitTag(evt)
-			unitInfo := unitMap[tag]
+			unitInfo, ok := unitMap[tag]
+			if !ok {
+				logUnknownUnit(env, evt, tag)
+				continue
+			}
 			newPlayerId := int(evt.Int("controlPlayerId"))
 
 			// I have found cases where the unit changes ownership at the same instant as it dies.
@@ -270,7 +369,11 @@ func Run(env *ProcessorEnv, filename string) error {
 		case TrackerEvtIDUnitTypeChange:
 			loop := evt.Loop()
 			tag := UnitTag(evt)
-			unitInfo := unitMap[tag]
+			unitInfo, ok := unitMap[tag]
+			if !ok {
+				logUnknownUnit(env, evt, tag)
+				continue
+			}
 			newType := evt.Stringv("unitTypeName")
 
 			if unitInfo.Alive {
@@ -311,8 +414,17 @@ func Run(env *ProcessorEnv, filename string) error {
 				log.Printf("player %d started building %s (%d)", unitInfo.PlayerId, unitInfo.UnitType, UnitTag(evt))
 			}
 
+			err := writeUnitEvent(newUnitEvent(evt, gameID, UnitEventInit, unitInfo))
+			if err != nil {
+				return err
+			}
+
 		case TrackerEvtIDUnitDone:
-			unitInfo := unitMap[UnitTag(evt)]
+			unitInfo, ok := unitMap[UnitTag(evt)]
+			if !ok {
+				logUnknownUnit(env, evt, UnitTag(evt))
+				continue
+			}
 			unitInfo.Alive = true
 
 			if env.Verbose >= VerboseSpam {
@@ -326,5 +438,38 @@ func Run(env *ProcessorEnv, filename string) error {
 		}
 	}
 
-	return MarkGameLoaded(env.DB, gameID)
+	for _, engagement := range DetectEngagements(deaths, lost, env.Engagements) {
+		for _, row := range engagement.Rows(gameID) {
+			if err := loader.WriteEngagement(&row); err != nil {
+				return stageErr(StageLoad, err)
+			}
+			rows[TableEngagements]++
+		}
+	}
+
+	// game events refer to players by user, and to units by the same tags as
+	// tracker events, so they are read once every unit is in unitMap
+	if replay.GameEvtsErr {
+		log.Printf("game events are incomplete, decoding failed part way: %s", filename)
+	}
+	playerIDs := gameEventPlayerIDs(replay)
+	for _, evt := range replay.GameEvts {
+		gameEvent, ok := parseGameEvent(evt, gameID, playerIDs, unitMap)
+		if !ok {
+			continue
+		}
+		if err := loader.WriteGameEvent(gameEvent); err != nil {
+			return stageErr(StageLoad, err)
+		}
+		rows[TableGameEvents]++
+	}
+
+	// replaces any previous copy of the game, computes its compvecs and then
+	// marks it as loaded
+	nextStage(StagePublish)
+	if err := loader.Publish(!env.SkipPostprocess); err != nil {
+		return stageErr(StagePublish, err)
+	}
+	env.Stats.Loaded(int64(len(replay.TrackerEvts.Evts)+len(replay.GameEvts)), rows)
+	return nil
 }
@@ -1,90 +1,196 @@
 package src
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"path"
+	"sync"
+	"time"
 
 	"cuelang.org/go/pkg/strconv"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 )
 
+// playbacks without any clients are stopped after this long
+const playbackIdleTimeout = 10 * time.Minute
+
 type ReplayServer struct {
-	Config *PlayerConfig
-	DB     *Singlestore
+	Config    *PlayerConfig
+	Store     Store
+	Playbacks *PlaybackManager
+	// Index is nil unless the vector index is enabled in the config
+	Index *VectorIndex
+	// Metrics is nil unless metrics are enabled in the config
+	Metrics *PlayerMetrics
+
+	kindsMu sync.Mutex
+	kinds   *KindRegistry
+
+	weightsMu sync.Mutex
+	weights   map[string]cachedKindWeights
 }
 
-func NewReplayServer(config *PlayerConfig, db *Singlestore) *ReplayServer {
-	return &ReplayServer{
-		Config: config,
-		DB:     db,
+// weights are reloaded after this long, since the tfidf weights are computed
+// from every game loaded so far
+const kindWeightsTTL = time.Minute
+
+type cachedKindWeights struct {
+	weights  KindWeights
+	loadedAt time.Time
+}
+
+func NewReplayServer(config *PlayerConfig, store Store) *ReplayServer {
+	var metrics *PlayerMetrics
+	if config.Metrics.Enabled {
+		metrics = NewPlayerMetrics(config.Metrics)
+		if db, ok := store.(*Singlestore); ok {
+			metrics.RegisterDBStats(db.DB)
+		}
+		store = InstrumentStore(store, metrics)
 	}
+
+	s := &ReplayServer{
+		Config:    config,
+		Store:     store,
+		Playbacks: NewPlaybackManager(playbackIdleTimeout),
+		Metrics:   metrics,
+		weights:   make(map[string]cachedKindWeights),
+	}
+	if config.VectorIndex.Enabled {
+		s.Index = NewVectorIndex(config.VectorIndex)
+		if metrics != nil {
+			metrics.RegisterVectorIndex(s.Index)
+		}
+		go s.Index.Run(store, nil)
+	}
+	return s
 }
 
 func (s *ReplayServer) RegisterRoutes(router gin.IRouter) error {
+	if s.Metrics != nil {
+		router.GET("/metrics", gin.WrapH(s.Metrics.Registry))
+	}
 	router.GET("/api/replays", s.ListReplays)
 	router.GET("/api/replays/:gameid", s.GetReplay)
 	router.GET("/api/replays/:gameid/timeline", s.GetReplayTimeline)
+	router.GET("/api/replays/:gameid/units", s.GetReplayUnitEvents)
+	router.GET("/api/replays/:gameid/engagements", s.GetReplayEngagements)
+	router.GET("/api/replays/:gameid/economy", s.GetReplayEconomy)
+	router.GET("/api/replays/:gameid/composition", s.GetReplayComposition)
 	router.GET("/api/replays/:gameid/similar", s.GetSimilarReplays)
+	router.GET("/api/compare", s.GetCompare)
 	router.GET("/api/icon/:kind", s.GetIcon)
+	router.GET("/api/kinds", s.ListKinds)
+	router.GET("/api/kinds/:kind", s.GetKind)
+	router.POST("/api/playback", s.StartPlayback)
+	router.GET("/api/playback/:id", s.GetPlayback)
+	router.DELETE("/api/playback/:id", s.StopPlayback)
+	router.GET("/api/playback/:id/stream", s.StreamPlayback)
+	router.GET("/api/playback/:id/similar/stream", s.StreamSimilarReplays)
+	router.POST("/api/playback/:id/:action", s.ControlPlayback)
 	return nil
 }
 
 type ReplayMeta struct {
-	GameID   string `json:"gameid"`
-	Filename string `json:"filename"`
-	Mapname  string `json:"mapname"`
-	Loops    int64  `json:"loops"`
-	P1Name   string `json:"p1Name"`
-	P1Race   string `json:"p1Race"`
-	P1Result string `json:"p1Result"`
-	P2Name   string `json:"p2Name"`
-	P2Race   string `json:"p2Race"`
-	P2Result string `json:"p2Result"`
+	GameID   string         `json:"gameid"`
+	Filename string         `json:"filename"`
+	Mapname  string         `json:"mapname"`
+	Loops    int64          `json:"loops"`
+	Matchup  string         `json:"matchup"`
+	Players  []ReplayPlayer `json:"players" db:"-"`
+}
+
+type ReplayPlayer struct {
+	PlayerID int    `json:"playerid"`
+	TeamID   int    `json:"teamid"`
+	Name     string `json:"name"`
+	Race     string `json:"race"`
+	Result   string `json:"result"`
+}
+
+type ReplayFilter struct {
+	Matchup string `form:"matchup"`
+	Player  string `form:"player"`
+	Limit   int    `form:"limit"`
 }
 
 func (s *ReplayServer) GetIcon(c *gin.Context) {
 	kind := c.Param("kind")
 	if kind == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "kind is required"})
+		c.JSON(http.StatusBadRequest, errorResponse(c, "kind is required"))
 		return
 	}
-	out := struct {
-		Icon string
+	icon, err := s.Store.KindIcon(kind)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	c.File(path.Join(s.Config.IconDir, fmt.Sprintf("%s.png", icon)))
+}
+
+func (s *ReplayServer) ListKinds(c *gin.Context) {
+	params := struct {
+		Category string `form:"category"`
 	}{}
-	err := s.DB.Get(&out, `
-		select icon from kind2icon where kind = ?
-	`, kind)
+
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	catalog, err := s.Store.LoadKindCatalog()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	out := make([]KindInfo, 0, len(catalog))
+	for _, info := range catalog {
+		if params.Category == "" || info.Category == params.Category {
+			out = append(out, info)
+		}
+	}
+
+	c.JSON(200, out)
+}
+
+func (s *ReplayServer) GetKind(c *gin.Context) {
+	kind := c.Param("kind")
+
+	catalog, err := s.Store.LoadKindCatalog()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
 		return
 	}
 
-	c.File(path.Join(s.Config.IconDir, fmt.Sprintf("%s.png", out.Icon)))
+	for _, info := range catalog {
+		if info.Kind == kind {
+			c.JSON(200, info)
+			return
+		}
+	}
+
+	c.JSON(http.StatusNotFound, errorResponse(c, fmt.Sprintf("kind not found: %s", kind)))
 }
 
 func (s *ReplayServer) GetReplay(c *gin.Context) {
 	gameid, err := ParamInt64(c, "gameid")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
 		return
 	}
 
-	out := &ReplayMeta{}
-	err = s.DB.Get(out, `
-		select
-			games.gameid, games.filename, games.mapname, games.loops,
-			p1.name p1name, p1.race p1race, p1.result p1result,
-			p2.name p2name, p2.race p2race, p2.result p2result
-		from games, players p1, players p2
-		where games.gameid = ?
-			and games.gameid = p1.gameid and p1.playerid = 1
-			and games.gameid = p2.gameid and p2.playerid = 2
-	`, gameid)
-
+	out, err := s.Store.GetReplay(gameid)
+	if errors.Is(err, ErrGameNotFound) {
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
 		return
 	}
 
@@ -92,48 +198,19 @@ func (s *ReplayServer) GetReplay(c *gin.Context) {
 }
 
 func (s *ReplayServer) ListReplays(c *gin.Context) {
-	params := struct {
-		Matchup string `form:"matchup"`
-		Player  string `form:"player"`
-		Limit   int    `form:"limit"`
-	}{}
+	params := ReplayFilter{}
 
 	if err := c.ShouldBindQuery(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
 		return
 	}
 	if params.Limit == 0 {
 		params.Limit = 100
 	}
 
-	out := []ReplayMeta{}
-
-	query, args, err := s.DB.BindNamed(`
-		select
-			games.gameid, games.filename, games.mapname,
-			p1.name p1name, p1.race p1race, p1.result p1result,
-			p2.name p2name, p2.race p2race, p2.result p2result
-		from games, players p1, players p2
-		where
-			games.gameid = p1.gameid and p1.playerid = 1
-			and games.gameid = p2.gameid and p2.playerid = 2
-			and (:matchup = "" or games.matchup = :matchup)
-			and (
-				:player = ""
-				or p1.name like concat("%",:player,"%")
-				or p2.name like concat("%",:player,"%")
-			)
-		order by if(games.gameid = -5280689129783593904, NULL, games.gameid) desc nulls first
-		limit :limit
-	`, params)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	err = s.DB.Select(&out, query, args...)
+	out, err := s.Store.ListReplays(params)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
 		return
 	}
 
@@ -151,73 +228,631 @@ func ParamInt64(c *gin.Context, name string) (int64, error) {
 func (s *ReplayServer) GetReplayTimeline(c *gin.Context) {
 	gameid, err := ParamInt64(c, "gameid")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	params := struct {
+		TimelineFilter
+		Cursor string `form:"cursor"`
+	}{}
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+	if err := params.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+	if err := params.ApplyCursor(params.Cursor); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
 		return
 	}
 
-	timeline, err := LoadTimeline(s.DB, gameid)
+	page, err := s.Store.LoadTimelinePage(gameid, params.TimelineFilter)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
 		return
 	}
 
-	c.JSON(200, timeline)
+	c.JSON(200, page)
 }
 
-type SimilarGamePoint struct {
-	GameID   string `json:"gameid"`
-	PlayerID int    `json:"playerid"`
-	LoopID   int64  `json:"loop"`
+func (s *ReplayServer) GetReplayUnitEvents(c *gin.Context) {
+	gameid, err := ParamInt64(c, "gameid")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	filter := UnitEventFilter{}
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+	if err := filter.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	out, err := s.Store.LoadUnitEvents(gameid, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	c.JSON(200, out)
+}
+
+func (s *ReplayServer) GetReplayEngagements(c *gin.Context) {
+	gameid, err := ParamInt64(c, "gameid")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	out, err := s.Store.LoadEngagements(gameid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	c.JSON(200, out)
+}
+
+func (s *ReplayServer) GetReplayEconomy(c *gin.Context) {
+	gameid, err := ParamInt64(c, "gameid")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	params := EconomyParams{}
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	timeline, err := s.Store.LoadTimeline(gameid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	c.JSON(200, ComputeEconomy(timeline, params))
+}
+
+func (s *ReplayServer) GetReplayComposition(c *gin.Context) {
+	gameid, err := ParamInt64(c, "gameid")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	params := CompositionParams{}
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+	if err := params.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	events, err := s.Store.LoadEvents(gameid, TimelineFilter{
+		FromLoop: params.MinLoop(),
+		ToLoop:   params.LoopID,
+		PlayerID: params.PlayerID,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	var catalog []KindInfo
+	if params.Values {
+		catalog, err = s.Store.LoadKindCatalog()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+			return
+		}
+	}
+
+	timeline := &Timeline{GameID: gameid, Events: events}
+	comps := timeline.Compositions(params.MinLoop(), params.LoopID)
+	c.JSON(200, NewGameComposition(gameid, params, comps, catalog))
+}
+
+// kindRegistry returns the cached kind registry
+// The registry is reloaded if comp contains a kind which the cached copy
+// doesn't know about, since that kind may have been added by the processor.
+func (s *ReplayServer) kindRegistry(comp Composition) (*KindRegistry, error) {
+	s.kindsMu.Lock()
+	defer s.kindsMu.Unlock()
+
+	if s.kinds == nil || !s.kinds.Covers(comp) {
+		kinds, err := s.Store.LoadKindRegistry()
+		if err != nil {
+			return nil, err
+		}
+		s.kinds = kinds
+	}
+	return s.kinds, nil
+}
+
+// kindWeights returns the cached weights for a weighting scheme
+func (s *ReplayServer) kindWeights(scheme string) (KindWeights, error) {
+	s.weightsMu.Lock()
+	defer s.weightsMu.Unlock()
+
+	cached, ok := s.weights[scheme]
+	if !ok || time.Since(cached.loadedAt) > kindWeightsTTL {
+		weights, err := s.Store.LoadKindWeights(scheme)
+		if err != nil {
+			return nil, err
+		}
+		cached = cachedKindWeights{weights: weights, loadedAt: time.Now()}
+		s.weights[scheme] = cached
+	}
+	return cached.weights, nil
+}
+
+// SimilarParams are the query parameters shared by the similar games endpoints
+type SimilarParams struct {
+	Lag     int64  `form:"lag"`
+	Limit   int    `form:"limit"`
+	Metric  string `form:"metric"`
+	Weights string `form:"weights"`
+	Engine  string `form:"engine"`
+}
+
+// newSimilarQuery loads the query for a player and applies params to it
+// The returned status code is only meaningful if err is not nil.
+func (s *ReplayServer) newSimilarQuery(gameid int64, playerid int, params *SimilarParams) (*SimilarQuery, int, error) {
+	metric, scheme, err := ValidateMetric(params.Metric, params.Weights)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	query, err := s.Store.LoadSimilarQuery(gameid, playerid)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	query.Lag = params.Lag
+	query.Limit = params.Limit
+	query.Metric = metric
+
+	if scheme != "" {
+		query.Weights, err = s.kindWeights(scheme)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+	return query, http.StatusOK, nil
+}
+
+// GetCompare compares two players' compositions, to show why one was found
+// to be similar to the other
+func (s *ReplayServer) GetCompare(c *gin.Context) {
+	params := CompareParams{}
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+	if err := params.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	metric, scheme, err := ValidateMetric(params.Metric, params.Weights)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	a, b := params.Refs()
+	rows, err := s.Store.CompareCompositions(a, b, params.Lag)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	all := make(Composition, len(rows))
+	for _, row := range rows {
+		all[row.Kind] = 1
+	}
+	kinds, err := s.kindRegistry(all)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	var weights KindWeights
+	if scheme != "" {
+		weights, err = s.kindWeights(scheme)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+			return
+		}
+	}
+
+	c.JSON(200, NewComparison(rows, kinds, params.Lag, metric, weights))
 }
 
 func (s *ReplayServer) GetSimilarReplays(c *gin.Context) {
 	gameid, err := ParamInt64(c, "gameid")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
 		return
 	}
 
 	params := struct {
+		SimilarParams
 		PlayerID int   `form:"playerid"`
 		LoopID   int64 `form:"loop"`
-		Lag      int64 `form:"lag"`
-		Limit    int   `form:"limit"`
 	}{}
 
 	if err := c.ShouldBindQuery(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
 		return
 	}
 
-	playerInfo := struct {
-		Race         string
-		OpponentRace string
+	query, status, err := s.newSimilarQuery(gameid, params.PlayerID, &params.SimilarParams)
+	if err != nil {
+		c.JSON(status, errorResponse(c, err.Error()))
+		return
+	}
+	query.LoopID = params.LoopID
+
+	comp, err := s.Store.LoadComposition(gameid, params.PlayerID, params.LoopID-params.Lag, params.LoopID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	if params.Engine == engineCompare {
+		out, err := s.compareSimilarGamePoints(query, comp)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+			return
+		}
+		c.JSON(200, out)
+		return
+	}
+
+	out, err := s.similarGamePoints(query, comp, params.Engine)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorResponse(c, err.Error()))
+		return
+	}
+
+	c.JSON(200, out)
+}
+
+func (s *ReplayServer) StartPlayback(c *gin.Context) {
+	params := struct {
+		GameID int64   `form:"gameid" binding:"required"`
+		Speed  float64 `form:"speed"`
+		LoopID int64   `form:"loop"`
+		Paused bool    `form:"paused"`
 	}{}
 
-	err = s.DB.Get(&playerInfo, `
-		select race, opponentrace
-		from players
-		where gameID = ? and playerID = ?
-	`, gameid, params.PlayerID)
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
 
+	timeline, err := s.Store.LoadTimeline(params.GameID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
 		return
 	}
 
-	out := []SimilarGamePoint{}
-	err = s.DB.Select(&out, `
-			select distinct gameid, playerid, loopid
-			from similarGamePoints(?, ?, ?, ?, ?, ?, ?)
-		`,
-		gameid, params.PlayerID, playerInfo.Race, playerInfo.OpponentRace,
-		params.LoopID, params.Lag, params.Limit,
-	)
+	playback := s.Playbacks.Start(timeline, params.Speed)
+	if params.Paused {
+		playback.Pause()
+	}
+	if params.LoopID > 0 {
+		playback.SeekLoop(params.LoopID)
+	}
+
+	c.JSON(200, playback.State())
+}
 
+func (s *ReplayServer) GetPlayback(c *gin.Context) {
+	playback, err := s.Playbacks.Get(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
 		return
 	}
 
-	c.JSON(200, out)
+	c.JSON(200, playback.State())
+}
+
+func (s *ReplayServer) StopPlayback(c *gin.Context) {
+	err := s.Playbacks.Stop(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *ReplayServer) ControlPlayback(c *gin.Context) {
+	playback, err := s.Playbacks.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
+		return
+	}
+
+	params := struct {
+		Speed  float64 `form:"speed"`
+		LoopID int64   `form:"loop"`
+	}{}
+
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+
+	var state PlaybackState
+	switch c.Param("action") {
+	case "pause":
+		state = playback.Pause()
+	case "resume":
+		state = playback.Resume()
+	case "seek":
+		state = playback.SeekLoop(params.LoopID)
+	case "speed":
+		if params.Speed <= 0 {
+			c.JSON(http.StatusBadRequest, errorResponse(c, "speed must be greater than 0"))
+			return
+		}
+		state = playback.SetSpeed(params.Speed)
+	default:
+		c.JSON(http.StatusNotFound, errorResponse(c, fmt.Sprintf("unknown playback action: %s", c.Param("action"))))
+		return
+	}
+
+	c.JSON(200, state)
+}
+
+// StreamPlayback pushes a playback's messages to the client as Server-Sent Events
+func (s *ReplayServer) StreamPlayback(c *gin.Context) {
+	playback, err := s.Playbacks.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
+		return
+	}
+
+	// the playback may have been stopped since Get
+	messages, err := playback.Subscribe()
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
+		return
+	}
+	defer playback.Unsubscribe(messages)
+
+	streamMessages(c, messages)
+}
+
+// StreamSimilarReplays pushes changes to the set of similar games as a
+// playback advances
+// The search is only repeated when the player's composition changes, and
+// only the games which were added, removed or moved are sent to the client.
+func (s *ReplayServer) StreamSimilarReplays(c *gin.Context) {
+	playback, err := s.Playbacks.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
+		return
+	}
+
+	params := struct {
+		SimilarParams
+		PlayerID int `form:"playerid" binding:"required"`
+	}{}
+
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, errorResponse(c, err.Error()))
+		return
+	}
+	if params.Limit == 0 {
+		params.Limit = 5
+	}
+
+	query, status, err := s.newSimilarQuery(playback.GameID(), params.PlayerID, &params.SimilarParams)
+	if err != nil {
+		c.JSON(status, errorResponse(c, err.Error()))
+		return
+	}
+
+	// the playback may have been stopped since Get
+	messages, err := playback.Subscribe()
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorResponse(c, err.Error()))
+		return
+	}
+	defer playback.Unsubscribe(messages)
+
+	updates := make(chan PlaybackMessage)
+	go s.watchSimilar(c.Request.Context(), playback, query, params.Engine, messages, updates)
+
+	streamMessages(c, updates)
+}
+
+// watchSimilar consumes playback messages and publishes a "similar" message
+// each time the set of similar games changes
+func (s *ReplayServer) watchSimilar(ctx context.Context, playback *Playback, query *SimilarQuery, engine string, messages <-chan PlaybackMessage, out chan<- PlaybackMessage) {
+	defer close(out)
+
+	send := func(msg PlaybackMessage) bool {
+		select {
+		case out <- msg:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var prev []SimilarGamePoint
+	var prevComp Composition
+
+	// search once straight away so the client doesn't wait for the next event
+	loop, dirty := playback.State().LoopID, true
+
+	for {
+		if dirty {
+			comp := playback.Timeline().Composition(query.PlayerID, loop-query.Lag, loop)
+			if prevComp == nil || !comp.Equal(prevComp) {
+				prevComp = comp
+				query.LoopID = loop
+
+				points, err := s.similarGamePoints(query, comp, engine)
+				if err != nil {
+					if !send(PlaybackMessage{Name: "error", Data: gin.H{"error": err.Error()}}) {
+						return
+					}
+				} else if update := DiffSimilar(loop, prev, points); !update.Empty() {
+					prev = points
+					if !send(PlaybackMessage{Name: "similar", Data: update}) {
+						return
+					}
+				}
+			}
+		}
+
+		// wait for the next message and then drain everything which arrived
+		// while we were searching, so a slow search never falls behind
+		var msg PlaybackMessage
+		var ok bool
+		select {
+		case msg, ok = <-messages:
+		case <-ctx.Done():
+			return
+		}
+
+		dirty = false
+		for ok {
+			switch data := msg.Data.(type) {
+			case PlaybackFrame:
+				loop = data.LoopID
+				for _, evt := range data.Events {
+					if evt.PlayerID == query.PlayerID {
+						dirty = true
+					}
+				}
+			case PlaybackSeek:
+				loop = data.LoopID
+				dirty = true
+			case PlaybackState:
+				if !send(PlaybackMessage{Name: "state", Data: data}) {
+					return
+				}
+			}
+
+			select {
+			case msg, ok = <-messages:
+				if !ok {
+					return
+				}
+				continue
+			default:
+			}
+			break
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// engineCompare runs a search with both engines, see compareSimilarGamePoints
+const engineCompare = "compare"
+
+// similarGamePoints searches with the given engine
+// If engine is empty the vector index is used once it has loaded, and the
+// store is used otherwise.
+func (s *ReplayServer) similarGamePoints(query *SimilarQuery, comp Composition, engine string) ([]SimilarGamePoint, error) {
+	kinds, err := s.kindRegistry(comp)
+	if err != nil {
+		return nil, err
+	}
+
+	if engine == "" {
+		engine = EngineStore
+		if s.Index != nil && s.Index.Ready() {
+			engine = EngineIndex
+		}
+	}
+
+	switch engine {
+	case EngineStore:
+		defer s.Metrics.observeSearch(engine, time.Now())
+		return s.Store.SimilarGamePoints(kinds, query, comp)
+	case EngineIndex:
+		if s.Index == nil {
+			return nil, errors.New("vector index is not enabled")
+		}
+		defer s.Metrics.observeSearch(engine, time.Now())
+		return s.Index.Search(kinds, query, comp)
+	default:
+		return nil, errors.Errorf("unknown search engine: %s", engine)
+	}
+}
+
+type SimilarComparison struct {
+	Store   []SimilarGamePoint `json:"store"`
+	Index   []SimilarGamePoint `json:"index"`
+	StoreMs float64            `json:"storeMs"`
+	IndexMs float64            `json:"indexMs"`
+	Recall  float64            `json:"recall"`
+}
+
+// compareSimilarGamePoints runs the same search against the store and the
+// vector index so that the accuracy of the index can be measured
+func (s *ReplayServer) compareSimilarGamePoints(query *SimilarQuery, comp Composition) (*SimilarComparison, error) {
+	out := &SimilarComparison{}
+
+	start := time.Now()
+	points, err := s.similarGamePoints(query, comp, EngineStore)
+	if err != nil {
+		return nil, err
+	}
+	out.Store = points
+	out.StoreMs = float64(time.Since(start).Microseconds()) / 1000
+
+	start = time.Now()
+	points, err = s.similarGamePoints(query, comp, EngineIndex)
+	if err != nil {
+		return nil, err
+	}
+	out.Index = points
+	out.IndexMs = float64(time.Since(start).Microseconds()) / 1000
+
+	out.Recall = SimilarRecall(out.Store, out.Index)
+	return out, nil
+}
+
+// streamMessages writes messages to the client as Server-Sent Events until
+// the channel is closed or the client goes away
+// A ping is sent every few seconds so that idle connections are kept open.
+func streamMessages(c *gin.Context, messages <-chan PlaybackMessage) {
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return false
+			}
+			c.SSEvent(msg.Name, msg.Data)
+		case <-ping.C:
+			c.SSEvent("ping", time.Now().Unix())
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
 }
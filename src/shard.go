@@ -0,0 +1,95 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPostprocessRunning is returned by ClaimPostprocess when another
+	// processor has claimed the run and not yet finished
+	ErrPostprocessRunning = errors.New("postprocess is already running for this run")
+	// ErrPostprocessDone is returned by ClaimPostprocess when the run has
+	// already been postprocessed
+	ErrPostprocessDone = errors.New("postprocess has already completed for this run")
+)
+
+// Shard selects the subset of the replays a processor is responsible for
+// Replays are assigned by the hash of their path relative to replayDir, so
+// every processor must be given the same replayDir layout.
+type Shard struct {
+	Index int
+	Count int
+}
+
+func (s Shard) Validate() error {
+	if s.Count < 1 {
+		return fmt.Errorf("shard count must be at least 1, got %d", s.Count)
+	}
+	if s.Index < 0 || s.Index >= s.Count {
+		return fmt.Errorf("shard index must be between 0 and %d, got %d", s.Count-1, s.Index)
+	}
+	return nil
+}
+
+// Owns returns true if the game belongs to this shard
+func (s Shard) Owns(gameID int64) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	return uint64(gameID)%uint64(s.Count) == uint64(s.Index)
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// ShardStatus records the progress of one shard of a processor run, see
+// processorshards in schema.sql
+type ShardStatus struct {
+	Run        string     `db:"run"`
+	Index      int        `db:"shardIndex"`
+	Count      int        `db:"shardCount"`
+	Host       string     `db:"host"`
+	StartedAt  time.Time  `db:"startedAt"`
+	FinishedAt *time.Time `db:"finishedAt"`
+}
+
+func (s *ShardStatus) Done() bool {
+	return s.FinishedAt != nil
+}
+
+// CheckShardsDone returns an error describing every shard of a run which has
+// not reported done
+func CheckShardsDone(run string, shards []ShardStatus) error {
+	if len(shards) == 0 {
+		return fmt.Errorf("no shards have started for run %s", run)
+	}
+
+	count := shards[0].Count
+	seen := make(map[int]*ShardStatus, len(shards))
+	for i := range shards {
+		shard := &shards[i]
+		if shard.Count != count {
+			return fmt.Errorf("shards of run %s disagree on the shard count: %d and %d", run, count, shard.Count)
+		}
+		seen[shard.Index] = shard
+	}
+
+	problems := make([]string, 0)
+	for i := 0; i < count; i++ {
+		shard, ok := seen[i]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("shard %d has not started", i))
+		case !shard.Done():
+			problems = append(problems, fmt.Sprintf("shard %d on %s is still running (started %s)", i, shard.Host, shard.StartedAt.Format(time.RFC3339)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("run %s is not complete: %s", run, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package src
+
+import "math"
+
+type SimilarGamePoint struct {
+	GameID   string  `json:"gameid"`
+	PlayerID int     `json:"playerid"`
+	LoopID   int64   `json:"loop"`
+	Dist     float64 `json:"dist"`
+}
+
+// SimilarQuery describes the player whose composition we are searching for
+type SimilarQuery struct {
+	GameID       int64
+	PlayerID     int
+	Race         string
+	OpponentRace string
+
+	LoopID int64
+	Lag    int64
+	Limit  int
+
+	// Metric is one of the Metric constants, Weights is nil if unweighted
+	Metric  string
+	Weights KindWeights
+}
+
+// SimilarUpdate describes how the set of similar games changed since the
+// previous update
+// Each other game and player pair appears at most once, at its closest point.
+type SimilarUpdate struct {
+	LoopID  int64              `json:"loop"`
+	Added   []SimilarGamePoint `json:"added"`
+	Changed []SimilarGamePoint `json:"changed"`
+	Removed []SimilarGamePoint `json:"removed"`
+}
+
+func (u *SimilarUpdate) Empty() bool {
+	return len(u.Added) == 0 && len(u.Changed) == 0 && len(u.Removed) == 0
+}
+
+type similarKey struct {
+	gameID   string
+	playerID int
+}
+
+// closestPoints keeps the closest point for each other game and player
+// points must be sorted by distance.
+func closestPoints(points []SimilarGamePoint) map[similarKey]SimilarGamePoint {
+	out := make(map[similarKey]SimilarGamePoint, len(points))
+	for _, p := range points {
+		key := similarKey{p.GameID, p.PlayerID}
+		if _, ok := out[key]; !ok {
+			out[key] = p
+		}
+	}
+	return out
+}
+
+// DiffSimilar compares two sets of search results
+func DiffSimilar(loop int64, prev []SimilarGamePoint, next []SimilarGamePoint) *SimilarUpdate {
+	update := &SimilarUpdate{
+		LoopID:  loop,
+		Added:   make([]SimilarGamePoint, 0),
+		Changed: make([]SimilarGamePoint, 0),
+		Removed: make([]SimilarGamePoint, 0),
+	}
+
+	prevPoints := closestPoints(prev)
+	nextPoints := closestPoints(next)
+
+	seen := make(map[similarKey]bool, len(next))
+	for _, p := range next {
+		key := similarKey{p.GameID, p.PlayerID}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		old, ok := prevPoints[key]
+		if !ok {
+			update.Added = append(update.Added, nextPoints[key])
+		} else if old != nextPoints[key] {
+			update.Changed = append(update.Changed, nextPoints[key])
+		}
+	}
+	for _, p := range prev {
+		key := similarKey{p.GameID, p.PlayerID}
+		if _, ok := nextPoints[key]; !ok && !seen[key] {
+			seen[key] = true
+			update.Removed = append(update.Removed, prevPoints[key])
+		}
+	}
+
+	return update
+}
+
+// SimilarRecall returns the fraction of the expected points which were found
+// Points are matched by game, player and distance rather than loop, since
+// several loops often have the same composition, and distances are rounded
+// since the store may compute them with less precision.
+func SimilarRecall(expected []SimilarGamePoint, found []SimilarGamePoint) float64 {
+	if len(expected) == 0 {
+		return 1
+	}
+
+	type key struct {
+		gameID   string
+		playerID int
+		dist     float64
+	}
+	round := func(dist float64) float64 {
+		return math.Round(dist*1e4) / 1e4
+	}
+	remaining := make(map[key]int, len(found))
+	for _, p := range found {
+		remaining[key{p.GameID, p.PlayerID, round(p.Dist)}]++
+	}
+
+	matched := 0
+	for _, p := range expected {
+		k := key{p.GameID, p.PlayerID, round(p.Dist)}
+		if remaining[k] > 0 {
+			remaining[k]--
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(expected))
+}
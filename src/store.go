@@ -0,0 +1,232 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	BackendSinglestore = "singlestore"
+	BackendMemory      = "memory"
+)
+
+// ErrGameNotFound is returned for games which don't exist or aren't loaded
+// yet
+var ErrGameNotFound = errors.New("game not found")
+
+// CompvecLoopInterval is the number of loops between two compvecs
+const CompvecLoopInterval = 80
+
+// NoLag marks compvecs which cover the whole game up to their loop
+const NoLag = -1
+
+// CompvecLags are the windows compvecs are computed over for every loop
+// This must match prepareCompvecs in schema.sql.
+var CompvecLags = []int64{
+	NoLag,
+	160,  // ~10 seconds
+	480,  // ~30 seconds
+	960,  // ~1 minute
+	2400, // ~2.5 minutes
+	4800, // ~5 minutes
+}
+
+// GameCompvecs computes the compvecs of every player in a game, every
+// CompvecLoopInterval loops up to loops for each of CompvecLags
+// timeline.Events must be sorted by loop. Each lag slides a CompositionWindow
+// through the game, so this is linear in the length of the game.
+func GameCompvecs(timeline *Timeline, players []Player, loops int64, kinds *KindRegistry) []Compvec {
+	out := make([]Compvec, 0)
+	for _, player := range players {
+		for _, lag := range CompvecLags {
+			window := timeline.CompositionWindow(player.PlayerID)
+			for loop := int64(CompvecLoopInterval); loop <= loops; loop += CompvecLoopInterval {
+				minLoop := loop - lag
+				if lag == NoLag || minLoop < 0 {
+					minLoop = 0
+				}
+
+				out = append(out, Compvec{
+					GameID:       timeline.GameID,
+					PlayerID:     player.PlayerID,
+					Race:         player.Race,
+					OpponentRace: player.OpponentRace,
+					LoopID:       loop,
+					LoopLag:      lag,
+					Version:      kinds.Version(),
+					Vec:          kinds.Vector(window.Advance(minLoop, loop)),
+				})
+			}
+		}
+	}
+	return out
+}
+
+// Store is implemented by each storage backend
+// Singlestore is the production backend, MemoryStore allows the processor
+// and player api to run without a cluster.
+type Store interface {
+	GameAlreadyLoaded(gameID int64) (bool, error)
+	// NewGameLoader stages a game, see GameLoader
+	NewGameLoader(game *Game, players []Player) (GameLoader, error)
+
+	// ListReplays and GetReplay only return loaded games, GetReplay returns
+	// ErrGameNotFound otherwise
+	ListReplays(filter ReplayFilter) ([]ReplayMeta, error)
+	GetReplay(gameID int64) (*ReplayMeta, error)
+	KindIcon(kind string) (string, error)
+	LoadKindCatalog() ([]KindInfo, error)
+	LoadTimeline(gameID int64) (*Timeline, error)
+	// LoadTimelinePage returns the first page of the timeline matching filter
+	LoadTimelinePage(gameID int64, filter TimelineFilter) (*TimelinePage, error)
+	// LoadEvents returns every build composition event matching filter,
+	// ordered by loop, without any stats and ignoring filter.Limit
+	LoadEvents(gameID int64, filter TimelineFilter) ([]Event, error)
+	LoadUnitEvents(gameID int64, filter UnitEventFilter) (*UnitEvents, error)
+	LoadEngagements(gameID int64) (*GameEngagements, error)
+	// LoadComposition returns a player's composition between minLoop and maxLoop
+	LoadComposition(gameID int64, playerID int, minLoop int64, maxLoop int64) (Composition, error)
+	// CompareCompositions returns both compositions over the lag loops before
+	// their loop, or the whole game up to it if lag is 0, lined up by kind
+	CompareCompositions(a CompositionRef, b CompositionRef, lag int64) ([]KindComparison, error)
+	LoadKindRegistry() (*KindRegistry, error)
+	// LoadKindWeights returns the weight of each kind under a weighting scheme
+	LoadKindWeights(scheme string) (KindWeights, error)
+	LoadSimilarQuery(gameID int64, playerID int) (*SimilarQuery, error)
+	// SimilarGamePoints returns the points in other games whose composition
+	// is closest to comp under the query's metric, comp must cover
+	// [LoopID-Lag, LoopID]
+	SimilarGamePoints(kinds *KindRegistry, query *SimilarQuery, comp Composition) ([]SimilarGamePoint, error)
+
+	// ListLoadedGames and LoadCompvecs are used to build a VectorIndex
+	ListLoadedGames() ([]LoadedGame, error)
+	LoadCompvecs(gameIDs []int64) ([]Compvec, error)
+
+	// StartShard, FinishShard and ListShards track the shards of a
+	// distributed processor run, see shard.go
+	StartShard(run string, shard Shard, host string) error
+	FinishShard(run string, shard Shard) error
+	ListShards(run string) ([]ShardStatus, error)
+	// ClaimPostprocess ensures the final postprocess of a run happens once,
+	// it returns ErrPostprocessRunning or ErrPostprocessDone if the run has
+	// already been claimed. force takes over a claim which never finished.
+	ClaimPostprocess(run string, force bool) error
+	// CompletePostprocess marks a claimed run as postprocessed, or releases
+	// the claim if the postprocess failed so it can be run again
+	CompletePostprocess(run string, succeeded bool) error
+	// Postprocess rebuilds the compvecs of every game and the kind weights
+	// Progress is recorded under run so it can resume if interrupted.
+	Postprocess(run string, config PostprocessConfig, progress PostprocessProgress) error
+
+	Close() error
+}
+
+// LoadedGame is a loaded game and the number of compvecs it has
+// A game published with -skip-postprocess has none until postprocess has
+// run, so the count tells a VectorIndex to load the game again.
+type LoadedGame struct {
+	GameID   int64 `db:"gameid"`
+	Compvecs int64 `db:"compvecs"`
+}
+
+// Compvec is a player's composition vector at a loop, see compvecs in schema.sql
+type Compvec struct {
+	GameID       int64
+	PlayerID     int
+	Race         string
+	OpponentRace string
+	LoopID       int64
+	LoopLag      int64
+	Version      int64
+	Vec          []float32
+}
+
+// GameLoader stages a game's stats, build composition changes, game events,
+// unit events and engagements
+// Publish atomically replaces any previous copy of the game with the staged
+// one, then computes its compvecs unless computeCompvecs is false, and only
+// then marks it as loaded. A game which isn't marked as loaded is hidden from
+// the game list and is loaded again by the next run, and if the processor dies
+// before publishing the staged rows are discarded at that point.
+// Abort discards the staged game, it is safe to call after Publish.
+type GameLoader interface {
+	WriteStats(stats *PlayerStats) error
+	WriteBuildComp(change *BuildCompChange) error
+	WriteGameEvent(event *GameEvent) error
+	WriteUnitEvent(event *UnitEvent) error
+	WriteEngagement(row *EngagementPlayer) error
+	Publish(computeCompvecs bool) error
+	Abort() error
+}
+
+type StoreConfig struct {
+	Backend     string
+	Singlestore SinglestoreConfig
+	Memory      MemoryConfig
+}
+
+func OpenStore(config StoreConfig) (Store, error) {
+	switch config.Backend {
+	case "", BackendSinglestore:
+		db, err := NewSinglestore(config.Singlestore)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case BackendMemory:
+		store, err := NewMemoryStore(config.Memory)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.Backend)
+	}
+}
+
+// sortSimilarPoints orders search results the same way as similarVecPoints
+// and keeps the closest distance for each game, player and loop
+func sortSimilarPoints(points []SimilarGamePoint, loop int64, limit int) []SimilarGamePoint {
+	abs := func(x int64) int64 {
+		if x < 0 {
+			return -x
+		}
+		return x
+	}
+	sort.Slice(points, func(i, j int) bool {
+		a, b := points[i], points[j]
+		if a.Dist != b.Dist {
+			return a.Dist < b.Dist
+		}
+		if da, db := abs(loop-a.LoopID), abs(loop-b.LoopID); da != db {
+			return da < db
+		}
+		if a.GameID != b.GameID {
+			ga, _ := strconv.ParseInt(a.GameID, 10, 64)
+			gb, _ := strconv.ParseInt(b.GameID, 10, 64)
+			return ga < gb
+		}
+		return a.PlayerID < b.PlayerID
+	})
+	if len(points) > limit {
+		points = points[:limit]
+	}
+
+	type key struct {
+		gameID   string
+		playerID int
+		loopID   int64
+	}
+	seen := make(map[key]bool, len(points))
+	out := make([]SimilarGamePoint, 0, len(points))
+	for _, p := range points {
+		k := key{p.GameID, p.PlayerID, p.LoopID}
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,1056 @@
+package src
+
+import (
+	"encoding/csv"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MemoryConfig struct {
+	// Path is the file the store is persisted to, so that the player api can
+	// read what the processor loaded. Nothing is persisted if it is empty.
+	Path string
+	// KindIconFile maps kinds to icons, defaults to data/kind2icon.csv
+	KindIconFile string
+	// KindCatalogFile is the unit catalog, defaults to data/kindcatalog.csv
+	KindCatalogFile string
+	// SaveIntervalMs is how often loaded games are saved to Path, defaults to
+	// 1000
+	SaveIntervalMs int
+}
+
+type memoryCompvec struct {
+	PlayerID int
+	LoopID   int64
+	LoopLag  int64
+	Version  int64
+	Vec      []float32
+}
+
+type memoryGame struct {
+	Game    Game
+	Players []Player
+	Loaded  bool
+	Events  []Event
+	Stats   []Stats
+	// GameEvents are kept so the memory backend matches SingleStore, nothing
+	// reads them yet
+	GameEvents  []GameEvent
+	UnitEvents  []MapEvent
+	Engagements []EngagementPlayer
+	Compvecs    []memoryCompvec
+}
+
+func (g *memoryGame) player(playerID int) (*Player, bool) {
+	for i := range g.Players {
+		if g.Players[i].PlayerID == playerID {
+			return &g.Players[i], true
+		}
+	}
+	return nil, false
+}
+
+func (g *memoryGame) timeline() *Timeline {
+	return &Timeline{GameID: g.Game.GameID, Events: g.Events, Stats: g.Stats}
+}
+
+// memoryPostprocessRun records a claim on the postprocess of a run
+type memoryPostprocessRun struct {
+	StartedAt  time.Time
+	FinishedAt *time.Time
+}
+
+// memorySnapshot is the on-disk format of a MemoryStore
+type memorySnapshot struct {
+	Games       map[int64]*memoryGame
+	Kinds       []string
+	Shards      map[string]map[int]*ShardStatus
+	Postprocess map[string]*memoryPostprocessRun
+}
+
+// MemoryStore keeps every table in memory and implements vector search in Go
+// It is intended for development and CI where a SingleStore cluster is not
+// available, and is not designed to hold the full replay corpus.
+type MemoryStore struct {
+	config MemoryConfig
+
+	mu          sync.RWMutex
+	games       map[int64]*memoryGame
+	kinds       []string
+	shards      map[string]map[int]*ShardStatus
+	postprocess map[string]*memoryPostprocessRun
+	icons       map[string]string
+	catalog     []KindInfo
+
+	// modification time of the snapshot we last loaded or saved, used to
+	// pick up changes written by another process
+	snapshotModTime time.Time
+	lastRefresh     time.Time
+
+	// version is bumped by every change, the snapshot on disk is up to date
+	// when it equals savedVersion
+	version      uint64
+	savedVersion uint64
+	// saveMu keeps saves from overtaking each other
+	saveMu    sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryStore(config MemoryConfig) (*MemoryStore, error) {
+	if config.KindIconFile == "" {
+		config.KindIconFile = "data/kind2icon.csv"
+	}
+
+	if config.KindCatalogFile == "" {
+		config.KindCatalogFile = "data/kindcatalog.csv"
+	}
+
+	if config.SaveIntervalMs <= 0 {
+		config.SaveIntervalMs = 1000
+	}
+
+	icons, err := loadKindIcons(config.KindIconFile)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := LoadKindCatalogFile(config.KindCatalogFile)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(catalog, func(i, j int) bool {
+		return catalog[i].Kind < catalog[j].Kind
+	})
+
+	s := &MemoryStore{
+		config:      config,
+		games:       make(map[int64]*memoryGame),
+		kinds:       make([]string, 0),
+		shards:      make(map[string]map[int]*ShardStatus),
+		postprocess: make(map[string]*memoryPostprocessRun),
+		icons:       icons,
+		catalog:     catalog,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	err = s.loadLocked()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go s.saveChanges()
+	return s, nil
+}
+
+func loadKindIcons(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	icons := make(map[string]string)
+	r := csv.NewReader(f)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return icons, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		icons[record[0]] = record[1]
+	}
+}
+
+// loadLocked replaces the contents of the store with the snapshot on disk
+func (s *MemoryStore) loadLocked() error {
+	if s.config.Path == "" {
+		return nil
+	}
+
+	f, err := os.Open(s.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	snapshot := memorySnapshot{}
+	err = gob.NewDecoder(f).Decode(&snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to decode memory store %s: %w", s.config.Path, err)
+	}
+
+	s.games = snapshot.Games
+	if s.games == nil {
+		s.games = make(map[int64]*memoryGame)
+	}
+	s.kinds = snapshot.Kinds
+	s.shards = snapshot.Shards
+	if s.shards == nil {
+		s.shards = make(map[string]map[int]*ShardStatus)
+	}
+	s.postprocess = snapshot.Postprocess
+	if s.postprocess == nil {
+		s.postprocess = make(map[string]*memoryPostprocessRun)
+	}
+	s.snapshotModTime = info.ModTime()
+	return nil
+}
+
+// changedLocked records a change which hasn't been saved yet
+func (s *MemoryStore) changedLocked() {
+	s.version++
+}
+
+// saveChanges saves the store every SaveIntervalMs if it has changed, until
+// Close is called
+// Saving rewrites the whole snapshot, so doing it after every game would make
+// loading many games quadratic.
+func (s *MemoryStore) saveChanges() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(time.Duration(s.config.SaveIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.saveIfChanged(); err != nil {
+				log.Printf("failed to save memory store %s: %v", s.config.Path, err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) saveIfChanged() error {
+	s.mu.RLock()
+	changed := s.version != s.savedVersion
+	s.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the store to disk, replacing the previous snapshot atomically
+func (s *MemoryStore) save() error {
+	if s.config.Path == "" {
+		return nil
+	}
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.config.Path), filepath.Base(s.config.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	s.mu.RLock()
+	version := s.version
+	err = gob.NewEncoder(tmp).Encode(&memorySnapshot{
+		Games:       s.games,
+		Kinds:       s.kinds,
+		Shards:      s.shards,
+		Postprocess: s.postprocess,
+	})
+	s.mu.RUnlock()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.config.Path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.config.Path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.snapshotModTime = info.ModTime()
+	s.savedVersion = version
+	s.mu.Unlock()
+	return nil
+}
+
+// refresh reloads the snapshot if another process has written a new one
+// The file is checked at most once per second.
+func (s *MemoryStore) refresh() error {
+	if s.config.Path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastRefresh) < time.Second {
+		return nil
+	}
+	s.lastRefresh = time.Now()
+
+	info, err := os.Stat(s.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// our own changes would be lost, they are saved over the other snapshot
+	// instead
+	if info.ModTime().Equal(s.snapshotModTime) || s.version != s.savedVersion {
+		return nil
+	}
+	return s.loadLocked()
+}
+
+func (s *MemoryStore) GameAlreadyLoaded(gameID int64) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	game, ok := s.games[gameID]
+	return ok && game.Loaded, nil
+}
+
+type memoryGameLoader struct {
+	store     *MemoryStore
+	game      *memoryGame
+	published bool
+}
+
+func (s *MemoryStore) NewGameLoader(game *Game, players []Player) (GameLoader, error) {
+	staged := &memoryGame{
+		Game:        *game,
+		Players:     make([]Player, len(players)),
+		Events:      make([]Event, 0),
+		GameEvents:  make([]GameEvent, 0),
+		UnitEvents:  make([]MapEvent, 0),
+		Engagements: make([]EngagementPlayer, 0),
+		Stats:       make([]Stats, 0),
+	}
+	copy(staged.Players, players)
+
+	return &memoryGameLoader{store: s, game: staged}, nil
+}
+
+func (l *memoryGameLoader) WriteStats(stats *PlayerStats) error {
+	l.game.Stats = append(l.game.Stats, Stats{
+		PlayerID:                         stats.PlayerID,
+		LoopID:                           stats.LoopID,
+		FoodMade:                         stats.FoodMade,
+		FoodUsed:                         stats.FoodUsed,
+		MineralsCollectionRate:           stats.MineralsCollectionRate,
+		MineralsCurrent:                  stats.MineralsCurrent,
+		VespeneCollectionRate:            stats.VespeneCollectionRate,
+		VespeneCurrent:                   stats.VespeneCurrent,
+		WorkersActiveCount:               stats.WorkersActiveCount,
+		MineralsUsedInProgressArmy:       stats.MineralsUsedInProgressArmy,
+		MineralsUsedInProgressEconomy:    stats.MineralsUsedInProgressEconomy,
+		MineralsUsedInProgressTechnology: stats.MineralsUsedInProgressTechnology,
+		VespeneUsedInProgressArmy:        stats.VespeneUsedInProgressArmy,
+		VespeneUsedInProgressEconomy:     stats.VespeneUsedInProgressEconomy,
+		VespeneUsedInProgressTechnology:  stats.VespeneUsedInProgressTechnology,
+		MineralsUsedCurrentArmy:          stats.MineralsUsedCurrentArmy,
+		MineralsUsedCurrentEconomy:       stats.MineralsUsedCurrentEconomy,
+		MineralsUsedCurrentTechnology:    stats.MineralsUsedCurrentTechnology,
+		VespeneUsedCurrentArmy:           stats.VespeneUsedCurrentArmy,
+		VespeneUsedCurrentEconomy:        stats.VespeneUsedCurrentEconomy,
+		VespeneUsedCurrentTechnology:     stats.VespeneUsedCurrentTechnology,
+		MineralsLostArmy:                 stats.MineralsLostArmy,
+		MineralsLostEconomy:              stats.MineralsLostEconomy,
+		MineralsLostTechnology:           stats.MineralsLostTechnology,
+		VespeneLostArmy:                  stats.VespeneLostArmy,
+		VespeneLostEconomy:               stats.VespeneLostEconomy,
+		VespeneLostTechnology:            stats.VespeneLostTechnology,
+		MineralsKilledArmy:               stats.MineralsKilledArmy,
+		MineralsKilledEconomy:            stats.MineralsKilledEconomy,
+		MineralsKilledTechnology:         stats.MineralsKilledTechnology,
+		VespeneKilledArmy:                stats.VespeneKilledArmy,
+		VespeneKilledEconomy:             stats.VespeneKilledEconomy,
+		VespeneKilledTechnology:          stats.VespeneKilledTechnology,
+		MineralsUsedActiveForces:         stats.MineralsUsedActiveForces,
+		VespeneUsedActiveForces:          stats.VespeneUsedActiveForces,
+		MineralsFriendlyFireArmy:         stats.MineralsFriendlyFireArmy,
+		MineralsFriendlyFireEconomy:      stats.MineralsFriendlyFireEconomy,
+		MineralsFriendlyFireTechnology:   stats.MineralsFriendlyFireTechnology,
+		VespeneFriendlyFireArmy:          stats.VespeneFriendlyFireArmy,
+		VespeneFriendlyFireEconomy:       stats.VespeneFriendlyFireEconomy,
+		VespeneFriendlyFireTechnology:    stats.VespeneFriendlyFireTechnology,
+	})
+	return nil
+}
+
+func (l *memoryGameLoader) WriteBuildComp(change *BuildCompChange) error {
+	l.game.Events = append(l.game.Events, Event{
+		PlayerID: change.PlayerID,
+		LoopID:   change.LoopID,
+		Kind:     change.Kind,
+		Num:      change.Num,
+	})
+	return nil
+}
+
+func (l *memoryGameLoader) WriteGameEvent(event *GameEvent) error {
+	l.game.GameEvents = append(l.game.GameEvents, *event)
+	return nil
+}
+
+func (l *memoryGameLoader) WriteUnitEvent(event *UnitEvent) error {
+	l.game.UnitEvents = append(l.game.UnitEvents, MapEvent{
+		UnitTag:        event.UnitTag,
+		PlayerID:       event.PlayerID,
+		LoopID:         event.LoopID,
+		Kind:           event.Kind,
+		EventType:      event.EventType,
+		X:              event.X,
+		Y:              event.Y,
+		KillerPlayerID: event.KillerPlayerID,
+		KillerUnitTag:  event.KillerUnitTag,
+		KillerKind:     event.KillerKind,
+	})
+	return nil
+}
+
+func (l *memoryGameLoader) WriteEngagement(row *EngagementPlayer) error {
+	l.game.Engagements = append(l.game.Engagements, *row)
+	return nil
+}
+
+// Publish swaps the staged game into the store in one step
+func (l *memoryGameLoader) Publish(computeCompvecs bool) error {
+	if l.published {
+		return nil
+	}
+	game := l.game
+
+	// match the order LoadTimeline uses in SingleStore
+	sort.SliceStable(game.Events, func(i, j int) bool {
+		if game.Events[i].LoopID != game.Events[j].LoopID {
+			return game.Events[i].LoopID < game.Events[j].LoopID
+		}
+		return game.Events[i].Kind < game.Events[j].Kind
+	})
+	sort.SliceStable(game.Stats, func(i, j int) bool {
+		if game.Stats[i].LoopID != game.Stats[j].LoopID {
+			return game.Stats[i].LoopID < game.Stats[j].LoopID
+		}
+		return game.Stats[i].PlayerID < game.Stats[j].PlayerID
+	})
+	sort.SliceStable(game.UnitEvents, func(i, j int) bool {
+		if game.UnitEvents[i].LoopID != game.UnitEvents[j].LoopID {
+			return game.UnitEvents[i].LoopID < game.UnitEvents[j].LoopID
+		}
+		return game.UnitEvents[i].UnitTag < game.UnitEvents[j].UnitTag
+	})
+
+	l.store.mu.Lock()
+	l.store.registerKindsLocked(game)
+	if computeCompvecs {
+		l.store.prepareCompvecsLocked(game)
+	}
+	game.Loaded = true
+	l.store.games[game.Game.GameID] = game
+	l.store.changedLocked()
+	l.store.mu.Unlock()
+
+	l.published = true
+	return nil
+}
+
+// Abort drops the staged game, it has no effect after Publish
+func (l *memoryGameLoader) Abort() error {
+	l.game = nil
+	return nil
+}
+
+// registerKindsLocked appends any new kinds in a game to the registry, in the
+// same order as publishGame
+func (s *MemoryStore) registerKindsLocked(game *memoryGame) {
+	known := make(map[string]bool, len(s.kinds))
+	for _, kind := range s.kinds {
+		known[kind] = true
+	}
+	newKinds := make([]string, 0)
+	for _, evt := range game.Events {
+		if !known[evt.Kind] {
+			known[evt.Kind] = true
+			newKinds = append(newKinds, evt.Kind)
+		}
+	}
+	sort.Strings(newKinds)
+	s.kinds = append(s.kinds, newKinds...)
+}
+
+// prepareCompvecsLocked computes the compvecs of a game
+func (s *MemoryStore) prepareCompvecsLocked(game *memoryGame) {
+	compvecs := GameCompvecs(game.timeline(), game.Players, game.Game.Loops, NewKindRegistry(s.kinds))
+
+	game.Compvecs = make([]memoryCompvec, 0, len(compvecs))
+	for _, c := range compvecs {
+		game.Compvecs = append(game.Compvecs, memoryCompvec{
+			PlayerID: c.PlayerID,
+			LoopID:   c.LoopID,
+			LoopLag:  c.LoopLag,
+			Version:  c.Version,
+			Vec:      c.Vec,
+		})
+	}
+}
+
+func (s *MemoryStore) replayMeta(game *memoryGame) ReplayMeta {
+	out := ReplayMeta{
+		GameID:   strconv.FormatInt(game.Game.GameID, 10),
+		Filename: game.Game.Filename,
+		Mapname:  game.Game.MapName,
+		Loops:    game.Game.Loops,
+		Matchup:  game.Game.Matchup,
+		Players:  make([]ReplayPlayer, 0, len(game.Players)),
+	}
+	for _, p := range game.Players {
+		out.Players = append(out.Players, ReplayPlayer{
+			PlayerID: p.PlayerID,
+			TeamID:   p.TeamID,
+			Name:     p.Name,
+			Race:     p.Race,
+			Result:   p.Result,
+		})
+	}
+	sort.Slice(out.Players, func(i, j int) bool {
+		return out.Players[i].PlayerID < out.Players[j].PlayerID
+	})
+	return out
+}
+
+// hasPlayerNamed returns true if any player's name contains name, which
+// must be lower case
+func hasPlayerNamed(players []ReplayPlayer, name string) bool {
+	for _, p := range players {
+		if strings.Contains(strings.ToLower(p.Name), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) ListReplays(filter ReplayFilter) ([]ReplayMeta, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	games := make([]*memoryGame, 0, len(s.games))
+	for _, game := range s.games {
+		games = append(games, game)
+	}
+	sort.Slice(games, func(i, j int) bool {
+		a, b := games[i].Game.GameID, games[j].Game.GameID
+		if a == featuredGameID || b == featuredGameID {
+			return a == featuredGameID
+		}
+		return a > b
+	})
+
+	player := strings.ToLower(filter.Player)
+	out := []ReplayMeta{}
+	for _, game := range games {
+		if len(out) >= filter.Limit {
+			break
+		}
+		if !game.Loaded {
+			continue
+		}
+		if filter.Matchup != "" && game.Game.Matchup != filter.Matchup {
+			continue
+		}
+		meta := s.replayMeta(game)
+		if player != "" && !hasPlayerNamed(meta.Players, player) {
+			continue
+		}
+		out = append(out, meta)
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) GetReplay(gameID int64) (*ReplayMeta, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	game, ok := s.games[gameID]
+	if !ok || !game.Loaded {
+		return nil, ErrGameNotFound
+	}
+	meta := s.replayMeta(game)
+	return &meta, nil
+}
+
+func (s *MemoryStore) KindIcon(kind string) (string, error) {
+	icon, ok := s.icons[kind]
+	if !ok {
+		return "", fmt.Errorf("no icon found for kind: %s", kind)
+	}
+	return icon, nil
+}
+
+func (s *MemoryStore) LoadKindCatalog() ([]KindInfo, error) {
+	out := make([]KindInfo, len(s.catalog))
+	copy(out, s.catalog)
+	return out, nil
+}
+
+func (s *MemoryStore) LoadTimeline(gameID int64) (*Timeline, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	game, ok := s.games[gameID]
+	if !ok || len(game.Events) == 0 {
+		return nil, fmt.Errorf("no events found for gameid: %d", gameID)
+	}
+	return game.timeline(), nil
+}
+
+func (s *MemoryStore) LoadTimelinePage(gameID int64, filter TimelineFilter) (*TimelinePage, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := &Timeline{GameID: gameID, Events: make([]Event, 0), Stats: make([]Stats, 0)}
+	game, ok := s.games[gameID]
+	if !ok {
+		return PageTimeline(out, &filter), nil
+	}
+	for i := range game.Events {
+		if filter.MatchesEvent(&game.Events[i]) {
+			out.Events = append(out.Events, game.Events[i])
+		}
+	}
+	for i := range game.Stats {
+		if filter.MatchesStats(&game.Stats[i]) {
+			out.Stats = append(out.Stats, game.Stats[i])
+		}
+	}
+	return PageTimeline(out, &filter), nil
+}
+
+func (s *MemoryStore) LoadUnitEvents(gameID int64, filter UnitEventFilter) (*UnitEvents, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := &UnitEvents{GameID: gameID, Events: make([]MapEvent, 0)}
+	game, ok := s.games[gameID]
+	if !ok {
+		return out, nil
+	}
+	for i := range game.UnitEvents {
+		if filter.Matches(&game.UnitEvents[i]) {
+			out.Events = append(out.Events, game.UnitEvents[i])
+		}
+	}
+	return out, nil
+}
+
+// LoadEngagements relies on the processor writing each game's engagements
+// in order
+func (s *MemoryStore) LoadEngagements(gameID int64) (*GameEngagements, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := &GameEngagements{GameID: gameID, Engagements: make([]Engagement, 0)}
+	if game, ok := s.games[gameID]; ok {
+		out.Engagements = GroupEngagements(game.Engagements)
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) LoadEvents(gameID int64, filter TimelineFilter) ([]Event, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Event, 0)
+	game, ok := s.games[gameID]
+	if !ok {
+		return out, nil
+	}
+	for i := range game.Events {
+		if filter.MatchesEvent(&game.Events[i]) {
+			out = append(out, game.Events[i])
+		}
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) LoadComposition(gameID int64, playerID int, minLoop int64, maxLoop int64) (Composition, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	game, ok := s.games[gameID]
+	if !ok {
+		return Composition{}, nil
+	}
+	return game.timeline().Composition(playerID, minLoop, maxLoop), nil
+}
+
+func (s *MemoryStore) CompareCompositions(a CompositionRef, b CompositionRef, lag int64) ([]KindComparison, error) {
+	compA, err := s.LoadComposition(a.GameID, a.PlayerID, WindowStart(a.LoopID, lag), a.LoopID)
+	if err != nil {
+		return nil, err
+	}
+	compB, err := s.LoadComposition(b.GameID, b.PlayerID, WindowStart(b.LoopID, lag), b.LoopID)
+	if err != nil {
+		return nil, err
+	}
+	return CompareCompositions(compA, compB), nil
+}
+
+func (s *MemoryStore) LoadKindRegistry() (*KindRegistry, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	kinds := make([]string, len(s.kinds))
+	copy(kinds, s.kinds)
+	return NewKindRegistry(kinds), nil
+}
+
+// LoadKindWeights supports value weights from the unit catalog and tfidf
+// weights, which are computed on demand
+func (s *MemoryStore) LoadKindWeights(scheme string) (KindWeights, error) {
+	switch scheme {
+	case WeightsValue:
+		return ValueWeights(s.catalog), nil
+	case WeightsTFIDF:
+	default:
+		return nil, fmt.Errorf("no weights found for scheme: %s", scheme)
+	}
+
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	type doc struct {
+		gameID   int64
+		playerID int
+	}
+	docs := make(map[doc]bool)
+	kindDocs := make(map[string]map[doc]bool)
+	for gameID, game := range s.games {
+		for _, evt := range game.Events {
+			if evt.Num <= 0 {
+				continue
+			}
+			d := doc{gameID, evt.PlayerID}
+			docs[d] = true
+			if kindDocs[evt.Kind] == nil {
+				kindDocs[evt.Kind] = make(map[doc]bool)
+			}
+			kindDocs[evt.Kind][d] = true
+		}
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no weights found for scheme: %s", scheme)
+	}
+
+	weights := make(KindWeights, len(kindDocs))
+	for kind, d := range kindDocs {
+		weights[kind] = inverseDocumentFrequency(len(d), len(docs))
+	}
+	return weights, nil
+}
+
+func (s *MemoryStore) LoadSimilarQuery(gameID int64, playerID int) (*SimilarQuery, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	game, ok := s.games[gameID]
+	if !ok {
+		return nil, fmt.Errorf("game %d does not exist", gameID)
+	}
+	player, ok := game.player(playerID)
+	if !ok {
+		return nil, fmt.Errorf("player %d does not exist in game %d", playerID, gameID)
+	}
+	return &SimilarQuery{
+		GameID:       gameID,
+		PlayerID:     playerID,
+		Race:         player.Race,
+		OpponentRace: player.OpponentRace,
+	}, nil
+}
+
+func (s *MemoryStore) SimilarGamePoints(kinds *KindRegistry, q *SimilarQuery, comp Composition) ([]SimilarGamePoint, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	vec := kinds.Vector(comp)
+	weights := kinds.WeightVector(q.Weights)
+	minLoop, maxLoop := q.LoopID-(q.Lag*2), q.LoopID+(q.Lag*2)
+
+	points := make([]SimilarGamePoint, 0)
+	for gameID, game := range s.games {
+		if gameID == q.GameID {
+			continue
+		}
+		for _, cv := range game.Compvecs {
+			if cv.LoopID < minLoop || cv.LoopID > maxLoop {
+				continue
+			}
+			player, ok := game.player(cv.PlayerID)
+			if !ok || player.Race != q.Race || player.OpponentRace != q.OpponentRace {
+				continue
+			}
+			// refuse vectors we can't re-project, just like similarVecPoints
+			other, err := kinds.Project(cv.Vec, cv.Version)
+			if err != nil {
+				continue
+			}
+			points = append(points, SimilarGamePoint{
+				GameID:   strconv.FormatInt(gameID, 10),
+				PlayerID: cv.PlayerID,
+				LoopID:   cv.LoopID,
+				Dist:     Distance(q.Metric, other, vec, weights),
+			})
+		}
+	}
+
+	return sortSimilarPoints(points, q.LoopID, q.Limit), nil
+}
+
+func (s *MemoryStore) ListLoadedGames() ([]LoadedGame, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]LoadedGame, 0, len(s.games))
+	for gameID, game := range s.games {
+		if game.Loaded {
+			out = append(out, LoadedGame{GameID: gameID, Compvecs: int64(len(game.Compvecs))})
+		}
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) LoadCompvecs(gameIDs []int64) ([]Compvec, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Compvec, 0)
+	for _, gameID := range gameIDs {
+		game, ok := s.games[gameID]
+		if !ok {
+			continue
+		}
+		for _, cv := range game.Compvecs {
+			player, ok := game.player(cv.PlayerID)
+			if !ok {
+				continue
+			}
+			out = append(out, Compvec{
+				GameID:       gameID,
+				PlayerID:     cv.PlayerID,
+				Race:         player.Race,
+				OpponentRace: player.OpponentRace,
+				LoopID:       cv.LoopID,
+				LoopLag:      cv.LoopLag,
+				Version:      cv.Version,
+				Vec:          cv.Vec,
+			})
+		}
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) StartShard(run string, shard Shard, host string) error {
+	s.mu.Lock()
+	if s.shards[run] == nil {
+		s.shards[run] = make(map[int]*ShardStatus)
+	}
+	s.shards[run][shard.Index] = &ShardStatus{
+		Run:       run,
+		Index:     shard.Index,
+		Count:     shard.Count,
+		Host:      host,
+		StartedAt: time.Now().UTC(),
+	}
+	s.changedLocked()
+	s.mu.Unlock()
+	return s.save()
+}
+
+func (s *MemoryStore) FinishShard(run string, shard Shard) error {
+	s.mu.Lock()
+	if status, ok := s.shards[run][shard.Index]; ok {
+		now := time.Now().UTC()
+		status.FinishedAt = &now
+	}
+	s.changedLocked()
+	s.mu.Unlock()
+	return s.save()
+}
+
+func (s *MemoryStore) ListShards(run string) ([]ShardStatus, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]ShardStatus, 0, len(s.shards[run]))
+	for _, status := range s.shards[run] {
+		out = append(out, *status)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Index < out[j].Index
+	})
+	return out, nil
+}
+
+func (s *MemoryStore) ClaimPostprocess(run string, force bool) error {
+	if err := s.refresh(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	claim, ok := s.postprocess[run]
+	if ok && claim.FinishedAt != nil {
+		s.mu.Unlock()
+		return ErrPostprocessDone
+	}
+	if ok && !force {
+		s.mu.Unlock()
+		return ErrPostprocessRunning
+	}
+	s.postprocess[run] = &memoryPostprocessRun{StartedAt: time.Now().UTC()}
+	s.changedLocked()
+	s.mu.Unlock()
+	return s.save()
+}
+
+func (s *MemoryStore) CompletePostprocess(run string, succeeded bool) error {
+	s.mu.Lock()
+	if claim, ok := s.postprocess[run]; ok && claim.FinishedAt == nil {
+		if succeeded {
+			now := time.Now().UTC()
+			claim.FinishedAt = &now
+		} else {
+			delete(s.postprocess, run)
+		}
+	}
+	s.changedLocked()
+	s.mu.Unlock()
+	return s.save()
+}
+
+// Postprocess recomputes the compvecs of every loaded game, kind weights are
+// computed on demand so there is nothing else to do
+// Each game only takes a moment, so it isn't worth resuming or splitting the
+// work between goroutines.
+func (s *MemoryStore) Postprocess(run string, config PostprocessConfig, progress PostprocessProgress) error {
+	s.mu.Lock()
+	gameIDs := make([]int64, 0, len(s.games))
+	for gameID, game := range s.games {
+		if game.Loaded {
+			gameIDs = append(gameIDs, gameID)
+		}
+	}
+	sort.Slice(gameIDs, func(i, j int) bool {
+		return gameIDs[i] < gameIDs[j]
+	})
+	for i, gameID := range gameIDs {
+		s.prepareCompvecsLocked(s.games[gameID])
+		if progress != nil {
+			progress(i+1, len(gameIDs))
+		}
+	}
+	s.changedLocked()
+	s.mu.Unlock()
+	return s.save()
+}
+
+// Close saves any changes which haven't been saved yet
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return s.saveIfChanged()
+}
+
+var _ Store = (*MemoryStore)(nil)
@@ -0,0 +1,919 @@
+package src
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// featuredGameID is always listed first, it's the game used in the demo
+const featuredGameID = -5280689129783593904
+
+func (db *Singlestore) GameAlreadyLoaded(gameid int64) (bool, error) {
+	row := sq.
+		Select("1").
+		From("games").
+		Where(sq.Eq{"gameid": gameid, "loaded": true}).
+		RunWith(db).
+		QueryRow()
+
+	var out string
+	err := row.Scan(&out)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// singlestoreGameLoader writes a game to the staging tables, publishGame then
+// moves it into the live tables in a single transaction
+// The build composition changes are also kept in memory, so that Publish can
+// compute the compvecs without reading them back.
+type singlestoreGameLoader struct {
+	db          *Singlestore
+	gameID      int64
+	loops       int64
+	players     []Player
+	events      []Event
+	stats       *Loader
+	buildComp   *Loader
+	gameEvents  *Loader
+	unitEvents  *Loader
+	engagements *Loader
+	done        bool
+}
+
+func (db *Singlestore) NewGameLoader(game *Game, players []Player) (GameLoader, error) {
+	// discard anything left behind by a previous attempt which didn't finish
+	_, err := db.Exec("call discardStagedGame(?)", game.GameID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sq.
+		Insert("games_staging").
+		SetMap(map[string]interface{}{
+			"gameID":      game.GameID,
+			"filename":    game.Filename,
+			"ts":          game.TS,
+			"loops":       game.Loops,
+			"durationSec": game.DurationSec,
+			"mapName":     game.MapName,
+			"gameVersion": game.GameVersion,
+			"matchup":     game.Matchup,
+		}).
+		RunWith(db).
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	query := sq.Insert("players_staging").RunWith(db).Columns(
+		"gameID", "playerID", "teamID", "regionID", "realmID", "toonID", "name", "race", "opponentRace", "mmr", "apm", "result",
+	)
+	for _, p := range players {
+		query = query.Values(
+			p.GameID, p.PlayerID, p.TeamID, p.RegionID, p.RealmID, p.ToonID, p.Name, p.Race, p.OpponentRace, p.MMR, p.APM, p.Result,
+		)
+	}
+	_, err = query.Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	return &singlestoreGameLoader{
+		db:          db,
+		gameID:      game.GameID,
+		loops:       game.Loops,
+		players:     players,
+		events:      make([]Event, 0),
+		stats:       NewLoader(db, "playerstats_staging", db.playerStatsSchema),
+		buildComp:   NewLoader(db, "buildcomp_staging", db.buildCompSchema),
+		gameEvents:  NewLoader(db, "gameevents_staging", db.gameEventSchema),
+		unitEvents:  NewLoader(db, "unitevents_staging", db.unitEventSchema),
+		engagements: NewLoader(db, "engagements_staging", db.engagementSchema),
+	}, nil
+}
+
+func (l *singlestoreGameLoader) WriteStats(stats *PlayerStats) error {
+	return l.stats.Encode(stats)
+}
+
+func (l *singlestoreGameLoader) WriteBuildComp(change *BuildCompChange) error {
+	l.events = append(l.events, Event{
+		PlayerID: change.PlayerID,
+		LoopID:   change.LoopID,
+		Kind:     change.Kind,
+		Num:      change.Num,
+	})
+	return l.buildComp.Encode(change)
+}
+
+func (l *singlestoreGameLoader) WriteGameEvent(event *GameEvent) error {
+	return l.gameEvents.Encode(event)
+}
+
+func (l *singlestoreGameLoader) WriteUnitEvent(event *UnitEvent) error {
+	return l.unitEvents.Encode(event)
+}
+
+func (l *singlestoreGameLoader) WriteEngagement(row *EngagementPlayer) error {
+	return l.engagements.Encode(row)
+}
+
+func (l *singlestoreGameLoader) closeLoaders() error {
+	statsErr := l.stats.Close()
+	buildCompErr := l.buildComp.Close()
+	gameEventsErr := l.gameEvents.Close()
+	unitEventsErr := l.unitEvents.Close()
+	engagementsErr := l.engagements.Close()
+	if statsErr != nil {
+		return fmt.Errorf("PlayerStats Loader failed: %w", statsErr)
+	}
+	if buildCompErr != nil {
+		return fmt.Errorf("BuildComp Loader failed: %w", buildCompErr)
+	}
+	if gameEventsErr != nil {
+		return fmt.Errorf("GameEvent Loader failed: %w", gameEventsErr)
+	}
+	if unitEventsErr != nil {
+		return fmt.Errorf("UnitEvent Loader failed: %w", unitEventsErr)
+	}
+	if engagementsErr != nil {
+		return fmt.Errorf("Engagement Loader failed: %w", engagementsErr)
+	}
+	return nil
+}
+
+func (l *singlestoreGameLoader) Publish(computeCompvecs bool) error {
+	if l.done {
+		return nil
+	}
+
+	err := l.closeLoaders()
+	if err != nil {
+		return err
+	}
+
+	_, err = l.db.Exec("call publishGame(?, ?)", l.gameID, !computeCompvecs)
+	if err != nil {
+		return err
+	}
+	l.done = true
+	if !computeCompvecs {
+		return nil
+	}
+
+	// publishGame registered the game's kinds, so the registry covers them
+	kinds, err := l.db.LoadKindRegistry()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(l.events, func(i, j int) bool {
+		return l.events[i].LoopID < l.events[j].LoopID
+	})
+	timeline := &Timeline{GameID: l.gameID, Events: l.events}
+	err = l.db.writeCompvecs(GameCompvecs(timeline, l.players, l.loops, kinds))
+	if err != nil {
+		return err
+	}
+
+	_, err = sq.
+		Update("games").
+		Set("loaded", true).
+		Where(sq.Eq{"gameid": l.gameID}).
+		RunWith(l.db).
+		Exec()
+	return err
+}
+
+// compvecsBatchSize is the number of compvecs written by each statement
+const compvecsBatchSize = 1000
+
+// writeCompvecs replaces the given compvecs, compvecs without a lag are
+// stored with a null looplag
+func (db *Singlestore) writeCompvecs(compvecs []Compvec) error {
+	for start := 0; start < len(compvecs); start += compvecsBatchSize {
+		end := start + compvecsBatchSize
+		if end > len(compvecs) {
+			end = len(compvecs)
+		}
+
+		query := sq.Replace("compvecs").RunWith(db).Columns(
+			"gameid", "playerid", "race", "opponentRace", "loopid", "looplag", "version", "vec",
+		)
+		for _, c := range compvecs[start:end] {
+			lag := sql.NullInt64{Int64: c.LoopLag, Valid: c.LoopLag != NoLag}
+			query = query.Values(
+				c.GameID, c.PlayerID, c.Race, c.OpponentRace, c.LoopID, lag, c.Version, PackVector(c.Vec),
+			)
+		}
+		if _, err := query.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *singlestoreGameLoader) Abort() error {
+	if l.done {
+		return nil
+	}
+	l.done = true
+
+	// the loaders are only closed so their goroutines exit, the staged rows
+	// are thrown away regardless
+	l.closeLoaders()
+
+	_, err := l.db.Exec("call discardStagedGame(?)", l.gameID)
+	return err
+}
+
+func (db *Singlestore) ListReplays(filter ReplayFilter) ([]ReplayMeta, error) {
+	out := []ReplayMeta{}
+
+	query, args, err := db.BindNamed(`
+		select games.gameid, games.filename, games.mapname, games.matchup
+		from games
+		where
+			games.loaded = true
+			and (:matchup = "" or games.matchup = :matchup)
+			and (
+				:player = ""
+				or games.gameid in (select gameid from players where name like concat("%",:player,"%"))
+			)
+		order by if(games.gameid = :featured, NULL, games.gameid) desc nulls first
+		limit :limit
+	`, map[string]interface{}{
+		"matchup":  filter.Matchup,
+		"player":   filter.Player,
+		"limit":    filter.Limit,
+		"featured": int64(featuredGameID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Select(&out, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return out, db.loadReplayPlayers(out)
+}
+
+// loadReplayPlayers fills in the players of each replay
+func (db *Singlestore) loadReplayPlayers(replays []ReplayMeta) error {
+	if len(replays) == 0 {
+		return nil
+	}
+
+	byGame := make(map[string]*ReplayMeta, len(replays))
+	gameIDs := make([]string, 0, len(replays))
+	for i := range replays {
+		replays[i].Players = make([]ReplayPlayer, 0)
+		byGame[replays[i].GameID] = &replays[i]
+		gameIDs = append(gameIDs, replays[i].GameID)
+	}
+
+	query, args, err := sq.
+		Select("gameid", "playerid", "teamid", "name", "race", "result").
+		From("players").
+		Where(sq.Eq{"gameid": gameIDs}).
+		OrderBy("gameid", "playerid").
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	rows := make([]struct {
+		GameID string
+		ReplayPlayer
+	}, 0)
+	err = db.Select(&rows, query, args...)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if replay, ok := byGame[row.GameID]; ok {
+			replay.Players = append(replay.Players, row.ReplayPlayer)
+		}
+	}
+	return nil
+}
+
+// timelineEventsQuery selects the buildcomp rows matching filter
+func timelineEventsQuery(gameID int64, filter *TimelineFilter, columns ...string) sq.SelectBuilder {
+	query := sq.Select(columns...).
+		From("buildcomp").
+		Where(sq.Eq{"gameid": gameID}).
+		Where(sq.GtOrEq{"loopid": filter.FromLoop})
+	if filter.ToLoop != 0 {
+		query = query.Where(sq.LtOrEq{"loopid": filter.ToLoop})
+	}
+	if filter.PlayerID != 0 {
+		query = query.Where(sq.Eq{"playerid": filter.PlayerID})
+	}
+	if len(filter.Kinds) > 0 {
+		query = query.Where(sq.Eq{"kind": filter.Kinds})
+	}
+	return query
+}
+
+// timelinePageEnd returns the last loop of the first page of events matching
+// filter, and false if every event fits on it
+// This is the same page PageTimeline cuts, without loading the whole window.
+func (db *Singlestore) timelinePageEnd(gameID int64, filter *TimelineFilter) (int64, bool, error) {
+	if filter.Limit == 0 {
+		return 0, false, nil
+	}
+
+	var end int64
+	query, args, err := timelineEventsQuery(gameID, filter, "loopid").
+		OrderBy("loopid").
+		Limit(1).
+		Offset(uint64(filter.Limit - 1)).
+		ToSql()
+	if err != nil {
+		return 0, false, err
+	}
+	err = db.Get(&end, query, args...)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	more := make([]int64, 0)
+	query, args, err = timelineEventsQuery(gameID, filter, "loopid").
+		Where(sq.Gt{"loopid": end}).
+		Limit(1).
+		ToSql()
+	if err != nil {
+		return 0, false, err
+	}
+	err = db.Select(&more, query, args...)
+	if err != nil {
+		return 0, false, err
+	}
+	return end, len(more) > 0, nil
+}
+
+func (db *Singlestore) LoadTimelinePage(gameID int64, filter TimelineFilter) (*TimelinePage, error) {
+	out := &TimelinePage{Timeline: Timeline{
+		GameID: gameID,
+		Events: make([]Event, 0),
+		Stats:  make([]Stats, 0),
+	}}
+
+	end, cut, err := db.timelinePageEnd(gameID, &filter)
+	if err != nil {
+		return nil, err
+	}
+	if cut {
+		filter.ToLoop = end
+		out.NextCursor = TimelineCursor(end + 1)
+	}
+
+	query, args, err := timelineEventsQuery(gameID, &filter, "playerid", "loopid", "kind", "num").
+		OrderBy("loopid", "kind").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Select(&out.Events, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := sq.Select("playerid", "loopid", playerStatsColumns).
+		From("playerstats").
+		Where(sq.Eq{"gameid": gameID}).
+		Where(sq.GtOrEq{"loopid": filter.FromLoop})
+	if filter.ToLoop != 0 {
+		stats = stats.Where(sq.LtOrEq{"loopid": filter.ToLoop})
+	}
+	if filter.PlayerID != 0 {
+		stats = stats.Where(sq.Eq{"playerid": filter.PlayerID})
+	}
+	query, args, err = stats.OrderBy("loopid", "playerid").ToSql()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Select(&out.Stats, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (db *Singlestore) LoadUnitEvents(gameID int64, filter UnitEventFilter) (*UnitEvents, error) {
+	events := make([]MapEvent, 0)
+
+	query, args, err := db.BindNamed(`
+		select
+			unittag, playerid, loopid, kind, eventtype, x, y,
+			killerplayerid, killerunittag, killerkind
+		from unitevents
+		where gameid = :gameid
+			and (:playerid = 0 or playerid = :playerid)
+			and (:eventtype = "" or eventtype = :eventtype)
+		order by loopid asc, unittag
+	`, map[string]interface{}{
+		"gameid":    gameID,
+		"playerid":  filter.PlayerID,
+		"eventtype": filter.EventType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Select(&events, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnitEvents{
+		GameID: gameID,
+		Events: events,
+	}, nil
+}
+
+func (db *Singlestore) LoadEngagements(gameID int64) (*GameEngagements, error) {
+	rows := make([]EngagementPlayer, 0)
+
+	err := db.Select(&rows, `
+		select
+			engagementid, playerid, startloop, endloop, x, y,
+			unitslost, unitskilled, mineralslost, vespenelost
+		from engagements
+		where gameid = ?
+		order by engagementid, playerid
+	`, gameID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GameEngagements{
+		GameID:      gameID,
+		Engagements: GroupEngagements(rows),
+	}, nil
+}
+
+func (db *Singlestore) GetReplay(gameid int64) (*ReplayMeta, error) {
+	out := &ReplayMeta{}
+	err := db.Get(out, `
+		select games.gameid, games.filename, games.mapname, games.loops, games.matchup
+		from games
+		where games.gameid = ? and games.loaded = true
+	`, gameid)
+	if err == sql.ErrNoRows {
+		return nil, ErrGameNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	replays := []ReplayMeta{*out}
+	if err := db.loadReplayPlayers(replays); err != nil {
+		return nil, err
+	}
+	return &replays[0], nil
+}
+
+func (db *Singlestore) KindIcon(kind string) (string, error) {
+	var icon string
+	err := db.Get(&icon, `
+		select icon from kind2icon where kind = ?
+	`, kind)
+	return icon, err
+}
+
+func (db *Singlestore) LoadKindCatalog() ([]KindInfo, error) {
+	out := make([]KindInfo, 0)
+	err := db.Select(&out, `
+		select kind, minerals, vespene, supply, buildtime, category
+		from kindcatalog
+		order by kind
+	`)
+	return out, err
+}
+
+// playerStatsColumns are the score values of Stats
+const playerStatsColumns = `
+	foodmade, foodused,
+	mineralscollectionrate, mineralscurrent,
+	vespenecollectionrate, vespenecurrent,
+	workersactivecount,
+	mineralsusedinprogressarmy, mineralsusedinprogresseconomy, mineralsusedinprogresstechnology,
+	vespeneusedinprogressarmy, vespeneusedinprogresseconomy, vespeneusedinprogresstechnology,
+	mineralsusedcurrentarmy, mineralsusedcurrenteconomy, mineralsusedcurrenttechnology,
+	vespeneusedcurrentarmy, vespeneusedcurrenteconomy, vespeneusedcurrenttechnology,
+	mineralslostarmy, mineralslosteconomy, mineralslosttechnology,
+	vespenelostarmy, vespenelosteconomy, vespenelosttechnology,
+	mineralskilledarmy, mineralskilledeconomy, mineralskilledtechnology,
+	vespenekilledarmy, vespenekilledeconomy, vespenekilledtechnology,
+	mineralsusedactiveforces, vespeneusedactiveforces,
+	mineralsfriendlyfirearmy, mineralsfriendlyfireeconomy, mineralsfriendlyfiretechnology,
+	vespenefriendlyfirearmy, vespenefriendlyfireeconomy, vespenefriendlyfiretechnology
+`
+
+func (db *Singlestore) LoadTimeline(gameID int64) (*Timeline, error) {
+	events := make([]Event, 0)
+	stats := make([]Stats, 0)
+
+	err := db.Select(&events, `
+		select playerid, loopid, kind, num
+		from buildcomp
+		where gameid = ?
+		order by loopid asc, kind
+	`, gameID)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events found for gameid: %d", gameID)
+	}
+
+	err = db.Select(&stats, `
+		select playerid, loopid, `+playerStatsColumns+`
+		from playerstats
+		where gameid = ?
+		order by loopid asc, playerid
+	`, gameID)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events found for gameid: %d", gameID)
+	}
+
+	return &Timeline{
+		GameID: gameID,
+		Events: events,
+		Stats:  stats,
+	}, nil
+}
+
+func (db *Singlestore) LoadEvents(gameID int64, filter TimelineFilter) ([]Event, error) {
+	out := make([]Event, 0)
+	query, args, err := timelineEventsQuery(gameID, &filter, "playerid", "loopid", "kind", "num").
+		OrderBy("loopid", "kind").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Select(&out, query, args...)
+	return out, err
+}
+
+func (db *Singlestore) LoadComposition(gameID int64, playerID int, minLoop int64, maxLoop int64) (Composition, error) {
+	rows := []struct {
+		Kind string
+		Num  int
+	}{}
+
+	err := db.Select(&rows, `
+		select kind, num from comp(?, ?, ?, ?)
+	`, gameID, playerID, minLoop, maxLoop)
+	if err != nil {
+		return nil, err
+	}
+
+	comp := make(Composition, len(rows))
+	for _, row := range rows {
+		comp[row.Kind] = row.Num
+	}
+	return comp, nil
+}
+
+func (db *Singlestore) CompareCompositions(a CompositionRef, b CompositionRef, lag int64) ([]KindComparison, error) {
+	out := make([]KindComparison, 0)
+	// compare() covers the whole game when the lag is null
+	sqlLag := sql.NullInt64{Int64: lag, Valid: lag != 0}
+	err := db.Select(&out, `
+		select kind, player1, player2 from compare(?, ?, ?, ?, ?, ?, ?)
+	`, a.GameID, a.PlayerID, a.LoopID, b.GameID, b.PlayerID, b.LoopID, sqlLag)
+	return out, err
+}
+
+func (db *Singlestore) LoadKindRegistry() (*KindRegistry, error) {
+	kinds := make([]string, 0)
+	err := db.Select(&kinds, `
+		select kind from uniquekind order by dim asc
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return NewKindRegistry(kinds), nil
+}
+
+func (db *Singlestore) LoadKindWeights(scheme string) (KindWeights, error) {
+	rows := []struct {
+		Kind   string
+		Weight float64
+	}{}
+	var err error
+	if scheme == WeightsTFIDF {
+		// computed on demand, since a plain ingest never runs
+		// prepareKindWeights
+		err = db.Select(&rows, "select kind, weight from tfidfWeights()")
+	} else {
+		err = db.Select(&rows, `
+			select kind, weight from kindweights where scheme = ?
+		`, scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no weights found for scheme: %s", scheme)
+	}
+
+	weights := make(KindWeights, len(rows))
+	for _, row := range rows {
+		weights[row.Kind] = row.Weight
+	}
+	return weights, nil
+}
+
+func (db *Singlestore) LoadSimilarQuery(gameID int64, playerID int) (*SimilarQuery, error) {
+	q := &SimilarQuery{GameID: gameID, PlayerID: playerID}
+	err := db.Get(q, `
+		select race, opponentrace
+		from players
+		where gameID = ? and playerID = ?
+	`, gameID, playerID)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (db *Singlestore) SimilarGamePoints(kinds *KindRegistry, q *SimilarQuery, comp Composition) ([]SimilarGamePoint, error) {
+	if (q.Metric != "" && q.Metric != MetricEuclidean) || q.Weights != nil {
+		return db.similarWeightedPoints(kinds, q, comp)
+	}
+
+	// the query vector is computed against the registry we were given, compvecs
+	// from older versions are re-projected and newer ones are excluded
+	out := []SimilarGamePoint{}
+	err := db.Select(&out, `
+			select gameid, playerid, loopid, min(dist) as dist
+			from similarVecPoints(?, ?, ?, ?, ?, ?, ?, ?)
+			group by gameid, playerid, loopid
+			order by dist asc, abs(? - loopid) asc, gameid, playerid
+		`,
+		q.GameID, q.Race, q.OpponentRace,
+		q.LoopID, q.Lag, q.Limit,
+		PackVector(kinds.Vector(comp)), kinds.Version(),
+		q.LoopID,
+	)
+	return out, err
+}
+
+func (db *Singlestore) ListLoadedGames() ([]LoadedGame, error) {
+	out := make([]LoadedGame, 0)
+	err := db.Select(&out, `
+		select games.gameid, count(compvecs.gameid) as compvecs
+		from games
+		left join compvecs on compvecs.gameid = games.gameid
+		where games.loaded = true
+		group by games.gameid
+	`)
+	return out, err
+}
+
+func (db *Singlestore) StartShard(run string, shard Shard, host string) error {
+	_, err := db.Exec(`
+		replace into processorshards (run, shardIndex, shardCount, host, startedAt, finishedAt)
+		values (?, ?, ?, ?, now(), null)
+	`, run, shard.Index, shard.Count, host)
+	return err
+}
+
+func (db *Singlestore) FinishShard(run string, shard Shard) error {
+	_, err := db.Exec(`
+		update processorshards set finishedAt = now()
+		where run = ? and shardIndex = ?
+	`, run, shard.Index)
+	return err
+}
+
+func (db *Singlestore) ListShards(run string) ([]ShardStatus, error) {
+	out := make([]ShardStatus, 0)
+	err := db.Select(&out, `
+		select run, shardIndex, shardCount, host, startedAt, finishedAt
+		from processorshards
+		where run = ?
+		order by shardIndex
+	`, run)
+	return out, err
+}
+
+func (db *Singlestore) ClaimPostprocess(run string, force bool) error {
+	if force {
+		_, err := db.Exec("delete from postprocessruns where run = ? and finishedAt is null", run)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := db.Exec("insert ignore into postprocessruns (run, startedAt) values (?, now())", run)
+	if err != nil {
+		return err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if claimed > 0 {
+		return nil
+	}
+
+	var finishedAt sql.NullTime
+	err = db.Get(&finishedAt, "select finishedAt from postprocessruns where run = ?", run)
+	if err != nil {
+		return err
+	}
+	if finishedAt.Valid {
+		return ErrPostprocessDone
+	}
+	return ErrPostprocessRunning
+}
+
+func (db *Singlestore) CompletePostprocess(run string, succeeded bool) error {
+	var err error
+	if succeeded {
+		_, err = db.Exec("update postprocessruns set finishedAt = now() where run = ?", run)
+	} else {
+		_, err = db.Exec("delete from postprocessruns where run = ? and finishedAt is null", run)
+	}
+	return err
+}
+
+// Postprocess does the same as postprocess() in schema.sql, except that the
+// compvecs are computed in chunks on several connections at once
+// Finished chunks are recorded in compvecchunks under run, so an interrupted
+// postprocess resumes where it left off as long as no games were loaded in
+// the meantime.
+func (db *Singlestore) Postprocess(run string, config PostprocessConfig, progress PostprocessProgress) error {
+	_, err := db.Exec("call prepareUniqueKinds()")
+	if err != nil {
+		return err
+	}
+
+	stats := struct {
+		NumGames int64 `db:"numGames"`
+		MaxLoop  int64 `db:"maxLoop"`
+		NumKinds int64 `db:"numKinds"`
+	}{}
+	err = db.Get(&stats, `
+		select
+			(select count(*) from games where loaded = true) as numGames,
+			(select ifnull(max(loops), 0) from games where loaded = true) as maxLoop,
+			(select count(*) from uniquekind) as numKinds
+	`)
+	if err != nil {
+		return err
+	}
+
+	// chunks finished while the games or kinds were different are stale
+	plan := fmt.Sprintf("games=%d maxLoop=%d kinds=%d chunkLoops=%d", stats.NumGames, stats.MaxLoop, stats.NumKinds, config.chunkLoops())
+	_, err = db.Exec("delete from compvecchunks where run = ? and plan != ?", run, plan)
+	if err != nil {
+		return err
+	}
+
+	finished := make([]CompvecChunk, 0)
+	err = db.Select(&finished, `
+		select looplag, fromLoop, toLoop from compvecchunks where run = ?
+	`, run)
+	if err != nil {
+		return err
+	}
+	skip := make(map[CompvecChunk]bool, len(finished))
+	for _, chunk := range finished {
+		skip[chunk] = true
+	}
+
+	chunks := make([]CompvecChunk, 0)
+	for _, chunk := range PlanCompvecChunks(stats.MaxLoop, config) {
+		if !skip[chunk] {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	err = runCompvecChunks(chunks, config, len(skip), progress, func(chunk CompvecChunk) error {
+		var lag interface{}
+		if chunk.Lag != NoLag {
+			lag = chunk.Lag
+		}
+		_, err := db.Exec("call prepareCompvecsRange(?, ?, ?, ?)", CompvecLoopInterval, chunk.FromLoop, chunk.ToLoop, lag)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			insert into compvecchunks (run, plan, looplag, fromLoop, toLoop, finishedAt)
+			values (?, ?, ?, ?, ?, now())
+		`, run, plan, chunk.Lag, chunk.FromLoop, chunk.ToLoop)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("call prepareKindWeights()")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("delete from compvecchunks where run = ?", run)
+	return err
+}
+
+func (db *Singlestore) LoadCompvecs(gameIDs []int64) ([]Compvec, error) {
+	if len(gameIDs) == 0 {
+		return []Compvec{}, nil
+	}
+
+	// compvecs which cover the whole game have a null looplag
+	query, args, err := sq.
+		Select(
+			"gameid", "playerid", "race", "opponentrace", "loopid",
+			fmt.Sprintf("ifnull(looplag, %d) as looplag", NoLag),
+			"version", "vec",
+		).
+		From("compvecs").
+		Where(sq.Eq{"gameid": gameIDs}).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []struct {
+		GameID       int64
+		PlayerID     int
+		Race         string
+		OpponentRace string
+		LoopID       int64
+		LoopLag      int64
+		Version      int64
+		Vec          []byte
+	}{}
+	err = db.Select(&rows, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Compvec, len(rows))
+	for i, row := range rows {
+		out[i] = Compvec{
+			GameID:       row.GameID,
+			PlayerID:     row.PlayerID,
+			Race:         row.Race,
+			OpponentRace: row.OpponentRace,
+			LoopID:       row.LoopID,
+			LoopLag:      row.LoopLag,
+			Version:      row.Version,
+			Vec:          UnpackVector(row.Vec),
+		}
+	}
+	return out, nil
+}
+
+// similarWeightedPoints is SimilarGamePoints for any metric
+// Both vectors are scaled by the square root of the weights in the database,
+// the query vector is scaled here.
+func (db *Singlestore) similarWeightedPoints(kinds *KindRegistry, q *SimilarQuery, comp Composition) ([]SimilarGamePoint, error) {
+	weights := kinds.WeightVector(q.Weights)
+	if weights == nil {
+		weights = kinds.WeightVector(KindWeights{})
+	}
+	weights = SqrtVector(weights)
+
+	vec := kinds.Vector(comp)
+	for i := range vec {
+		vec[i] *= weights[i]
+	}
+
+	out := []SimilarGamePoint{}
+	err := db.Select(&out, `
+			select gameid, playerid, loopid, min(dist) as dist
+			from similarWeightedPoints(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			group by gameid, playerid, loopid
+			order by dist asc, abs(? - loopid) asc, gameid, playerid
+		`,
+		q.GameID, q.Race, q.OpponentRace,
+		q.LoopID, q.Lag, q.Limit,
+		PackVector(vec), kinds.Version(),
+		q.Metric, PackVector(weights),
+		q.LoopID,
+	)
+	return out, err
+}
+
+var _ Store = (*Singlestore)(nil)
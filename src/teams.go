@@ -0,0 +1,112 @@
+package src
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/icza/s2prot/rep"
+)
+
+// playerSlot returns the lobby slot of the i-th player in
+// replay.Details.Players()
+// Replays from before working set slots were recorded list the players in
+// the same order as their occupied slots, leaving out observers.
+func playerSlot(replay *rep.Rep, i int) (*rep.Slot, bool) {
+	player := &replay.Details.Players()[i]
+	slots := replay.InitData.LobbyState.Slots
+
+	if player.Value("workingSetSlotId") != nil {
+		for j := range slots {
+			if slots[j].Value("workingSetSlotId") != nil && slots[j].WorkingSetSlotID() == player.WorkingSetSlotID() {
+				return &slots[j], true
+			}
+		}
+		return nil, false
+	}
+
+	n := 0
+	for j := range slots {
+		control := slots[j].Control()
+		if (control != rep.ControlHuman && control != rep.ControlComputer) || slots[j].Int("observe") != 0 {
+			continue
+		}
+		if n == i {
+			return &slots[j], true
+		}
+		n++
+	}
+	return nil, false
+}
+
+// replayTeamIDs returns the team of each player in replay.Details.Players()
+// The details only sometimes record the right team, so it is taken from the
+// player's lobby slot when there is one.
+func replayTeamIDs(replay *rep.Rep) []int {
+	players := replay.Details.Players()
+	out := make([]int, len(players))
+	for i := range players {
+		out[i] = int(players[i].TeamID())
+		if slot, ok := playerSlot(replay, i); ok {
+			out[i] = int(slot.TeamID())
+		}
+	}
+	return out
+}
+
+// replayMetaPlayers returns the metadata of each player by player ID
+// Replays from before patch 3.0 don't have any metadata, and replays of
+// games which were left early may be missing some players.
+func replayMetaPlayers(replay *rep.Rep) map[int]*rep.MetaPlayer {
+	metaPlayers := replay.Metadata.Players()
+	out := make(map[int]*rep.MetaPlayer, len(metaPlayers))
+	for i := range metaPlayers {
+		out[int(metaPlayers[i].PlayerID())] = &metaPlayers[i]
+	}
+	return out
+}
+
+// teamOrder returns the team IDs in players in the order they first appear
+func teamOrder(players []Player) []int {
+	out := make([]int, 0)
+	seen := make(map[int]bool)
+	for _, p := range players {
+		if !seen[p.TeamID] {
+			seen[p.TeamID] = true
+			out = append(out, p.TeamID)
+		}
+	}
+	return out
+}
+
+// TeamMatchup returns the race letters of each team separated by 'v', e.g.
+// "PvT" or "PTvZZ"
+// Teams are ordered by their first player, so a 1v1 matchup is the same as
+// Details.Matchup().
+func TeamMatchup(players []Player) string {
+	teams := make([]string, 0)
+	for _, teamID := range teamOrder(players) {
+		letters := ""
+		for _, p := range players {
+			if p.TeamID == teamID && p.Race != "" {
+				letters += p.Race[:1]
+			}
+		}
+		teams = append(teams, letters)
+	}
+	return strings.Join(teams, "v")
+}
+
+// OpponentRace returns the races of everyone not on the player's team
+// In a 1v1 this is the opponent's race, otherwise it is the sorted races
+// joined with commas, so compvecs are only compared between games with the
+// same races on the other side.
+func OpponentRace(players []Player, player *Player) string {
+	races := make([]string, 0, len(players))
+	for _, p := range players {
+		if p.TeamID != player.TeamID {
+			races = append(races, p.Race)
+		}
+	}
+	sort.Strings(races)
+	return strings.Join(races, ",")
+}
@@ -2,6 +2,8 @@ package src
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 )
 
 type Event struct {
@@ -22,6 +24,40 @@ type Stats struct {
 	MineralsCurrent        int `json:"mineralsCurrent"`
 	VespeneCollectionRate  int `json:"vespeneCollectionRate"`
 	VespeneCurrent         int `json:"vespeneCurrent"`
+
+	WorkersActiveCount               int `json:"workersActiveCount"`
+	MineralsUsedInProgressArmy       int `json:"mineralsUsedInProgressArmy"`
+	MineralsUsedInProgressEconomy    int `json:"mineralsUsedInProgressEconomy"`
+	MineralsUsedInProgressTechnology int `json:"mineralsUsedInProgressTechnology"`
+	VespeneUsedInProgressArmy        int `json:"vespeneUsedInProgressArmy"`
+	VespeneUsedInProgressEconomy     int `json:"vespeneUsedInProgressEconomy"`
+	VespeneUsedInProgressTechnology  int `json:"vespeneUsedInProgressTechnology"`
+	MineralsUsedCurrentArmy          int `json:"mineralsUsedCurrentArmy"`
+	MineralsUsedCurrentEconomy       int `json:"mineralsUsedCurrentEconomy"`
+	MineralsUsedCurrentTechnology    int `json:"mineralsUsedCurrentTechnology"`
+	VespeneUsedCurrentArmy           int `json:"vespeneUsedCurrentArmy"`
+	VespeneUsedCurrentEconomy        int `json:"vespeneUsedCurrentEconomy"`
+	VespeneUsedCurrentTechnology     int `json:"vespeneUsedCurrentTechnology"`
+	MineralsLostArmy                 int `json:"mineralsLostArmy"`
+	MineralsLostEconomy              int `json:"mineralsLostEconomy"`
+	MineralsLostTechnology           int `json:"mineralsLostTechnology"`
+	VespeneLostArmy                  int `json:"vespeneLostArmy"`
+	VespeneLostEconomy               int `json:"vespeneLostEconomy"`
+	VespeneLostTechnology            int `json:"vespeneLostTechnology"`
+	MineralsKilledArmy               int `json:"mineralsKilledArmy"`
+	MineralsKilledEconomy            int `json:"mineralsKilledEconomy"`
+	MineralsKilledTechnology         int `json:"mineralsKilledTechnology"`
+	VespeneKilledArmy                int `json:"vespeneKilledArmy"`
+	VespeneKilledEconomy             int `json:"vespeneKilledEconomy"`
+	VespeneKilledTechnology          int `json:"vespeneKilledTechnology"`
+	MineralsUsedActiveForces         int `json:"mineralsUsedActiveForces"`
+	VespeneUsedActiveForces          int `json:"vespeneUsedActiveForces"`
+	MineralsFriendlyFireArmy         int `json:"mineralsFriendlyFireArmy"`
+	MineralsFriendlyFireEconomy      int `json:"mineralsFriendlyFireEconomy"`
+	MineralsFriendlyFireTechnology   int `json:"mineralsFriendlyFireTechnology"`
+	VespeneFriendlyFireArmy          int `json:"vespeneFriendlyFireArmy"`
+	VespeneFriendlyFireEconomy       int `json:"vespeneFriendlyFireEconomy"`
+	VespeneFriendlyFireTechnology    int `json:"vespeneFriendlyFireTechnology"`
 }
 
 type Timeline struct {
@@ -30,47 +66,197 @@ type Timeline struct {
 	Stats  []Stats `json:"stats"`
 }
 
-func LoadTimeline(db *Singlestore, gameID int64) (*Timeline, error) {
-	events := make([]Event, 0)
-	stats := make([]Stats, 0)
+func (t *Timeline) MaxLoopID() int64 {
+	maxLoop := t.Events[len(t.Events)-1].LoopID
+	if len(t.Stats) > 0 && t.Stats[len(t.Stats)-1].LoopID > maxLoop {
+		maxLoop = t.Stats[len(t.Stats)-1].LoopID
+	}
+	return maxLoop
+}
+
+// Composition sums a player's events between minLoop and maxLoop (inclusive)
+// Kinds which sum to zero are left out.
+func (t *Timeline) Composition(playerID int, minLoop int64, maxLoop int64) Composition {
+	start := sort.Search(len(t.Events), func(i int) bool { return t.Events[i].LoopID >= minLoop })
 
-	err := db.Select(&events, `
-		select playerid, loopid, kind, num
-		from buildcomp
-		where gameid = ?
-		order by loopid asc, kind
-	`, gameID)
-	if err != nil {
-		return nil, err
+	comp := make(Composition)
+	for _, evt := range t.Events[start:] {
+		if evt.LoopID > maxLoop {
+			break
+		}
+		if evt.PlayerID == playerID {
+			comp[evt.Kind] += evt.Num
+		}
 	}
-	if len(events) == 0 {
-		return nil, fmt.Errorf("no events found for gameid: %d", gameID)
+	for kind, num := range comp {
+		if num == 0 {
+			delete(comp, kind)
+		}
 	}
+	return comp
+}
 
-	err = db.Select(&stats, `
-		select
-			playerid, loopid,
-			foodmade, foodused,
-			mineralscollectionrate, mineralscurrent,
-			vespenecollectionrate, vespenecurrent
-		from playerstats
-		where gameid = ?
-		order by loopid asc, playerid
-	`, gameID)
-	if err != nil {
-		return nil, err
+// Compositions is Composition for every player with events in the window
+func (t *Timeline) Compositions(minLoop int64, maxLoop int64) map[int]Composition {
+	start := sort.Search(len(t.Events), func(i int) bool { return t.Events[i].LoopID >= minLoop })
+
+	out := make(map[int]Composition)
+	for _, evt := range t.Events[start:] {
+		if evt.LoopID > maxLoop {
+			break
+		}
+		comp, ok := out[evt.PlayerID]
+		if !ok {
+			comp = make(Composition)
+			out[evt.PlayerID] = comp
+		}
+		comp[evt.Kind] += evt.Num
 	}
-	if len(events) == 0 {
-		return nil, fmt.Errorf("no events found for gameid: %d", gameID)
+	for _, comp := range out {
+		for kind, num := range comp {
+			if num == 0 {
+				delete(comp, kind)
+			}
+		}
 	}
+	return out
+}
 
-	return &Timeline{
-		GameID: gameID,
-		Events: events,
-		Stats:  stats,
-	}, nil
+// CompositionWindow computes Composition for a window which only moves
+// forward, by adding the events which enter it and removing the ones which
+// leave it, so that stepping through a long game isn't quadratic
+type CompositionWindow struct {
+	timeline *Timeline
+	playerID int
+	sums     map[string]int
+	// timeline.Events[start:end] are in the window
+	start int
+	end   int
 }
 
-func (t *Timeline) MaxLoopID() int64 {
-	return t.Events[len(t.Events)-1].LoopID
+func (t *Timeline) CompositionWindow(playerID int) *CompositionWindow {
+	return &CompositionWindow{timeline: t, playerID: playerID, sums: make(map[string]int)}
+}
+
+// Advance moves the window to cover minLoop to maxLoop (inclusive) and
+// returns the same Composition as Timeline.Composition
+// Neither bound may be lower than in the previous call.
+func (w *CompositionWindow) Advance(minLoop int64, maxLoop int64) Composition {
+	events := w.timeline.Events
+	for ; w.end < len(events) && events[w.end].LoopID <= maxLoop; w.end++ {
+		if events[w.end].PlayerID == w.playerID {
+			w.sums[events[w.end].Kind] += events[w.end].Num
+		}
+	}
+	for ; w.start < w.end && events[w.start].LoopID < minLoop; w.start++ {
+		if events[w.start].PlayerID == w.playerID {
+			w.sums[events[w.start].Kind] -= events[w.start].Num
+		}
+	}
+
+	comp := make(Composition, len(w.sums))
+	for kind, num := range w.sums {
+		if num != 0 {
+			comp[kind] = num
+		}
+	}
+	return comp
+}
+
+// TimelineFilter selects part of a timeline, see Store.LoadTimelinePage
+type TimelineFilter struct {
+	FromLoop int64 `form:"fromLoop"`
+	// ToLoop is the last loop included, 0 is the end of the game
+	ToLoop   int64 `form:"toLoop"`
+	PlayerID int   `form:"playerid"`
+	// Kinds only applies to events, stats are returned for every kind
+	Kinds []string `form:"kind"`
+	// Limit is the number of events in each page, 0 returns the whole window
+	// Pages always end on a whole loop, so the last loop of a page can take it
+	// over the limit.
+	Limit int `form:"limit"`
+}
+
+func (f *TimelineFilter) Validate() error {
+	if f.FromLoop < 0 {
+		return fmt.Errorf("fromLoop must not be negative")
+	}
+	if f.ToLoop != 0 && f.ToLoop < f.FromLoop {
+		return fmt.Errorf("toLoop must not be before fromLoop")
+	}
+	if f.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+	return nil
+}
+
+// InWindow returns true if loop is between FromLoop and ToLoop
+func (f *TimelineFilter) InWindow(loop int64) bool {
+	return loop >= f.FromLoop && (f.ToLoop == 0 || loop <= f.ToLoop)
+}
+
+func (f *TimelineFilter) MatchesEvent(evt *Event) bool {
+	if !f.InWindow(evt.LoopID) || (f.PlayerID != 0 && evt.PlayerID != f.PlayerID) {
+		return false
+	}
+	if len(f.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range f.Kinds {
+		if evt.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *TimelineFilter) MatchesStats(stats *Stats) bool {
+	return f.InWindow(stats.LoopID) && (f.PlayerID == 0 || stats.PlayerID == f.PlayerID)
+}
+
+// TimelinePage is one page of a filtered timeline
+// NextCursor is empty on the last page, otherwise it is passed back as the
+// cursor parameter along with the same filter to fetch the next page.
+type TimelinePage struct {
+	Timeline
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// TimelineCursor returns the cursor of the page which starts at loop
+func TimelineCursor(loop int64) string {
+	return strconv.FormatInt(loop, 10)
+}
+
+// ApplyCursor moves the start of the filter to where the cursor's page starts
+func (f *TimelineFilter) ApplyCursor(cursor string) error {
+	if cursor == "" {
+		return nil
+	}
+	loop, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || loop < f.FromLoop {
+		return fmt.Errorf("invalid cursor: %s", cursor)
+	}
+	f.FromLoop = loop
+	return nil
+}
+
+// PageTimeline cuts a filtered timeline down to the first page
+// The events and stats must already match the filter and be ordered by loop.
+func PageTimeline(timeline *Timeline, filter *TimelineFilter) *TimelinePage {
+	out := &TimelinePage{Timeline: *timeline}
+	if filter.Limit == 0 || len(timeline.Events) <= filter.Limit {
+		return out
+	}
+
+	end := timeline.Events[filter.Limit-1].LoopID
+	if timeline.Events[len(timeline.Events)-1].LoopID == end {
+		return out
+	}
+
+	n := sort.Search(len(timeline.Events), func(i int) bool { return timeline.Events[i].LoopID > end })
+	out.Events = timeline.Events[:n]
+	n = sort.Search(len(timeline.Stats), func(i int) bool { return timeline.Stats[i].LoopID > end })
+	out.Stats = timeline.Stats[:n]
+	out.NextCursor = TimelineCursor(end + 1)
+	return out
 }
@@ -0,0 +1,83 @@
+package src
+
+import (
+	"fmt"
+
+	"github.com/icza/s2prot"
+)
+
+// MapEvent is a UnitEvent as returned by the player api
+type MapEvent struct {
+	UnitTag   int64  `json:"unitTag"`
+	PlayerID  int    `json:"playerid"`
+	LoopID    int64  `json:"loopid"`
+	Kind      string `json:"kind"`
+	EventType string `json:"type"`
+	X         int    `json:"x"`
+	Y         int    `json:"y"`
+
+	KillerPlayerID *int    `json:"killerPlayerid,omitempty"`
+	KillerUnitTag  *int64  `json:"killerUnitTag,omitempty"`
+	KillerKind     *string `json:"killerKind,omitempty"`
+}
+
+type UnitEvents struct {
+	GameID int64      `json:"gameid"`
+	Events []MapEvent `json:"events"`
+}
+
+type UnitEventFilter struct {
+	PlayerID  int    `form:"playerid"`
+	EventType string `form:"type"`
+}
+
+func (f UnitEventFilter) Validate() error {
+	switch f.EventType {
+	case "", UnitEventBorn, UnitEventInit, UnitEventDied:
+		return nil
+	}
+	return fmt.Errorf("type must be one of %s, %s or %s", UnitEventBorn, UnitEventInit, UnitEventDied)
+}
+
+func (f UnitEventFilter) Matches(evt *MapEvent) bool {
+	if f.PlayerID != 0 && evt.PlayerID != f.PlayerID {
+		return false
+	}
+	if f.EventType != "" && evt.EventType != f.EventType {
+		return false
+	}
+	return true
+}
+
+// newUnitEvent reads the position of a UnitBorn or UnitInit event
+func newUnitEvent(evt s2prot.Event, gameID int64, eventType string, unitInfo *UnitInfo) *UnitEvent {
+	return &UnitEvent{
+		GameID:    gameID,
+		UnitTag:   UnitTag(evt),
+		LoopID:    evt.Loop(),
+		PlayerID:  unitInfo.PlayerId,
+		Kind:      unitInfo.UnitType,
+		EventType: eventType,
+		X:         int(evt.Int("x")),
+		Y:         int(evt.Int("y")),
+	}
+}
+
+// newUnitDiedEvent reads the position and killer of a UnitDied event
+// The killer unit is looked up in unitMap, older replays don't record it.
+func newUnitDiedEvent(evt s2prot.Event, gameID int64, unitInfo *UnitInfo, unitMap map[int64]*UnitInfo) *UnitEvent {
+	out := newUnitEvent(evt, gameID, UnitEventDied, unitInfo)
+
+	if evt.Value("killerPlayerId") != nil {
+		out.KillerPlayerID = intPtr(evt.Int("killerPlayerId"))
+	}
+	if evt.Value("killerUnitTagIndex") != nil {
+		tag := (evt.Int("killerUnitTagIndex") << 18) + evt.Int("killerUnitTagRecycle")
+		out.KillerUnitTag = &tag
+		if killer, ok := unitMap[tag]; ok {
+			kind := killer.UnitType
+			out.KillerKind = &kind
+		}
+	}
+	return out
+}
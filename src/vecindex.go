@@ -0,0 +1,530 @@
+package src
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// EngineStore answers similarity searches with the storage backend,
+	// which is a full scan of compvecs in SingleStore
+	EngineStore = "store"
+	// EngineIndex answers similarity searches with the in-process VectorIndex
+	EngineIndex = "index"
+)
+
+// partitions smaller than this are scanned rather than clustered
+const vecIndexMinClusterSize = 1024
+
+// number of kmeans iterations and the number of sampled vectors per cluster
+// used to train each partition
+const (
+	vecIndexTrainIterations = 8
+	vecIndexTrainSamples    = 32
+)
+
+// number of games loaded from the store at a time
+const vecIndexLoadBatch = 64
+
+type VectorIndexConfig struct {
+	// Enabled loads compvecs into the player api at startup so that similar
+	// games can be found without a round trip to the database
+	Enabled bool
+	// BucketLoops is the width of each loop bucket, defaults to 960 (~1 minute)
+	BucketLoops int64
+	// NProbe is the number of clusters searched in each bucket, defaults to 8
+	NProbe int
+	// RefreshMs is how often newly loaded games are added, defaults to 30000
+	RefreshMs int
+}
+
+// indexedVec is a compvec stored sparsely, most kinds are zero in any
+// given composition
+type indexedVec struct {
+	gameID   int64
+	playerID int
+	loopID   int64
+	version  int64
+	dims     []int32
+	vals     []float32
+	norm     float64 // squared length
+}
+
+func newIndexedVec(cv *Compvec) indexedVec {
+	v := indexedVec{
+		gameID:   cv.GameID,
+		playerID: cv.PlayerID,
+		loopID:   cv.LoopID,
+		version:  cv.Version,
+	}
+	for dim, val := range cv.Vec {
+		if val != 0 {
+			v.dims = append(v.dims, int32(dim))
+			v.vals = append(v.vals, val)
+			v.norm += float64(val) * float64(val)
+		}
+	}
+	return v
+}
+
+// dist2 returns the squared euclidean distance between v and a dense vector
+// Dense vectors are padded with zeros, the same way older compvecs are
+// re-projected onto a newer kind registry.
+func (v *indexedVec) dist2(dense []float32, denseNorm float64) float64 {
+	out := denseNorm + v.norm
+	for i, dim := range v.dims {
+		val := float64(v.vals[i])
+		if int(dim) < len(dense) {
+			d := float64(dense[dim])
+			out += (d-val)*(d-val) - d*d - val*val
+		}
+	}
+	if out < 0 {
+		return 0
+	}
+	return out
+}
+
+// distance computes the distance between v and a dense query vector under
+// metric, see Distance
+// queryNorm is the weighted squared length of the query.
+func (v *indexedVec) distance(metric string, query []float32, weights []float32, queryNorm float64) float64 {
+	var dot, norm float64
+	for i, dim := range v.dims {
+		w, x, y := 1.0, float64(v.vals[i]), float64(query[dim])
+		if weights != nil {
+			w = float64(weights[dim])
+		}
+		dot += w * x * y
+		norm += w * x * x
+	}
+
+	if metric == MetricCosine {
+		return cosineDistance(dot, norm, queryNorm)
+	}
+	// |q - v|^2 = |q|^2 + |v|^2 - 2 q.v, clamped since it can round below 0
+	return math.Sqrt(math.Max(0, queryNorm+norm-2*dot))
+}
+
+type vecCluster struct {
+	centroid []float32
+	norm     float64
+	vecs     []indexedVec
+}
+
+// vecPartition holds every compvec for a race, opponent race and loop bucket
+// Partitions are never modified once they are published to the index, a
+// refresh replaces them instead, so searches don't need to hold a lock.
+type vecPartition struct {
+	// clusters has a single cluster without a centroid if the partition is
+	// too small to be worth clustering
+	clusters []vecCluster
+	size     int
+	// size of the partition when it was last clustered
+	trainedSize int
+}
+
+type vecPartitionKey struct {
+	race         string
+	opponentRace string
+	bucket       int64
+}
+
+// VectorIndex is an in-process IVF index over compvecs
+// Vectors are partitioned by race, opponent race and loop bucket, and each
+// partition is clustered with kmeans. A search only visits the buckets which
+// overlap the loop window and the NProbe closest clusters in each, so the
+// results are approximate; use engine=compare on the similar games endpoint to
+// measure recall against the store.
+type VectorIndex struct {
+	config VectorIndexConfig
+
+	refreshMu sync.Mutex
+
+	mu         sync.RWMutex
+	partitions map[vecPartitionKey]*vecPartition
+	// number of compvecs each game had in the store when it was loaded
+	games map[int64]int64
+	size  int
+	ready bool
+}
+
+func NewVectorIndex(config VectorIndexConfig) *VectorIndex {
+	if config.BucketLoops <= 0 {
+		config.BucketLoops = 960
+	}
+	if config.NProbe <= 0 {
+		config.NProbe = 8
+	}
+	if config.RefreshMs <= 0 {
+		config.RefreshMs = 30000
+	}
+	return &VectorIndex{
+		config:     config,
+		partitions: make(map[vecPartitionKey]*vecPartition),
+		games:      make(map[int64]int64),
+	}
+}
+
+// Ready returns true once the index has loaded every game at least once
+func (idx *VectorIndex) Ready() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.ready
+}
+
+// Size returns the number of games and vectors in the index
+func (idx *VectorIndex) Size() (int, int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.games), idx.size
+}
+
+// Run refreshes the index from the store until done is closed
+func (idx *VectorIndex) Run(store Store, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(idx.config.RefreshMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if err := idx.Refresh(store); err != nil {
+			log.Printf("unable to refresh vector index: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Refresh adds games which were loaded since the last refresh and removes
+// games which are no longer loaded
+// Games whose number of compvecs changed, such as those published with
+// -skip-postprocess once postprocess has run, are loaded again.
+func (idx *VectorIndex) Refresh(store Store) error {
+	idx.refreshMu.Lock()
+	defer idx.refreshMu.Unlock()
+
+	start := time.Now()
+
+	loaded, err := store.ListLoadedGames()
+	if err != nil {
+		return err
+	}
+
+	idx.mu.RLock()
+	games := make(map[int64]int64, len(loaded))
+	added := make([]int64, 0)
+	removed := make(map[int64]bool)
+	for _, game := range loaded {
+		games[game.GameID] = game.Compvecs
+		count, ok := idx.games[game.GameID]
+		if !ok || count != game.Compvecs {
+			added = append(added, game.GameID)
+		}
+		// drop the old vectors of a game which is being loaded again
+		if ok && count != game.Compvecs {
+			removed[game.GameID] = true
+		}
+	}
+	for gameID := range idx.games {
+		if _, ok := games[gameID]; !ok {
+			removed[gameID] = true
+		}
+	}
+	partitions := make(map[vecPartitionKey]*vecPartition, len(idx.partitions))
+	for key, p := range idx.partitions {
+		partitions[key] = p
+	}
+	idx.mu.RUnlock()
+
+	newVecs := make(map[vecPartitionKey][]indexedVec)
+	for i := 0; i < len(added); i += vecIndexLoadBatch {
+		end := i + vecIndexLoadBatch
+		if end > len(added) {
+			end = len(added)
+		}
+		compvecs, err := store.LoadCompvecs(added[i:end])
+		if err != nil {
+			return err
+		}
+		for j := range compvecs {
+			cv := &compvecs[j]
+			key := idx.partitionKey(cv.Race, cv.OpponentRace, cv.LoopID)
+			newVecs[key] = append(newVecs[key], newIndexedVec(cv))
+		}
+	}
+
+	// rebuild every partition which gained or lost vectors
+	changed := make([]vecPartitionKey, 0, len(newVecs))
+	for key := range newVecs {
+		changed = append(changed, key)
+	}
+	if len(removed) > 0 {
+		for key := range partitions {
+			if _, ok := newVecs[key]; !ok {
+				changed = append(changed, key)
+			}
+		}
+	}
+
+	rebuilt := make([]*vecPartition, len(changed))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				rebuilt[i] = rebuildPartition(partitions[changed[i]], newVecs[changed[i]], removed)
+			}
+		}()
+	}
+	for i := range changed {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	size := 0
+	for i, key := range changed {
+		if rebuilt[i].size == 0 {
+			delete(partitions, key)
+		} else {
+			partitions[key] = rebuilt[i]
+		}
+	}
+	for _, p := range partitions {
+		size += p.size
+	}
+
+	idx.mu.Lock()
+	idx.partitions = partitions
+	idx.games = games
+	idx.size = size
+	idx.ready = true
+	idx.mu.Unlock()
+
+	if len(added) > 0 || len(removed) > 0 {
+		log.Printf("vector index: added %d games, removed %d games, %d games and %d vectors in %d partitions, took %s",
+			len(added), len(removed), len(games), size, len(partitions), time.Since(start))
+	}
+	return nil
+}
+
+func (idx *VectorIndex) partitionKey(race string, opponentRace string, loopID int64) vecPartitionKey {
+	return vecPartitionKey{race, opponentRace, loopID / idx.config.BucketLoops}
+}
+
+// rebuildPartition returns a copy of old without the removed games and with
+// the added vectors
+// The partition is re-clustered once it has doubled in size since it was last
+// clustered, otherwise the new vectors are assigned to the closest cluster.
+func rebuildPartition(old *vecPartition, added []indexedVec, removed map[int64]bool) *vecPartition {
+	vecs := make([]indexedVec, 0)
+	out := &vecPartition{}
+	if old != nil {
+		out.trainedSize = old.trainedSize
+		out.clusters = make([]vecCluster, len(old.clusters))
+		for i, c := range old.clusters {
+			out.clusters[i].centroid = c.centroid
+			out.clusters[i].norm = c.norm
+			for _, v := range c.vecs {
+				if !removed[v.gameID] {
+					vecs = append(vecs, v)
+					out.clusters[i].vecs = append(out.clusters[i].vecs, v)
+				}
+			}
+		}
+	}
+	vecs = append(vecs, added...)
+	out.size = len(vecs)
+
+	clustered := len(out.clusters) > 0 && out.clusters[0].centroid != nil
+	switch {
+	case len(vecs) < vecIndexMinClusterSize:
+		out.clusters = []vecCluster{{vecs: vecs}}
+		out.trainedSize = 0
+	case !clustered || len(vecs) >= out.trainedSize*2:
+		out.clusters = trainClusters(vecs)
+		out.trainedSize = len(vecs)
+	default:
+		for _, v := range added {
+			i := closestCluster(out.clusters, &v)
+			out.clusters[i].vecs = append(out.clusters[i].vecs, v)
+		}
+	}
+	return out
+}
+
+// trainClusters runs kmeans over a sample of vecs and assigns every vector to
+// its closest centroid
+func trainClusters(vecs []indexedVec) []vecCluster {
+	k := int(math.Sqrt(float64(len(vecs))))
+
+	sample := vecs
+	if len(vecs) > k*vecIndexTrainSamples {
+		sample = make([]indexedVec, 0, k*vecIndexTrainSamples)
+		step := float64(len(vecs)) / float64(k*vecIndexTrainSamples)
+		for i := 0; i < k*vecIndexTrainSamples; i++ {
+			sample = append(sample, vecs[int(float64(i)*step)])
+		}
+	}
+
+	dims := 0
+	for i := range vecs {
+		if n := len(vecs[i].dims); n > 0 && int(vecs[i].dims[n-1]) >= dims {
+			dims = int(vecs[i].dims[n-1]) + 1
+		}
+	}
+
+	// seed the centroids with evenly spaced samples so that the index is the
+	// same every time it is built
+	clusters := make([]vecCluster, k)
+	for i := range clusters {
+		clusters[i].centroid = make([]float32, dims)
+		setCentroid(&clusters[i], []indexedVec{sample[i*len(sample)/k]})
+	}
+
+	assignments := make([]int, len(sample))
+	for iter := 0; iter < vecIndexTrainIterations; iter++ {
+		members := make([][]indexedVec, k)
+		for i := range sample {
+			assignments[i] = closestCluster(clusters, &sample[i])
+			members[assignments[i]] = append(members[assignments[i]], sample[i])
+		}
+		for i := range clusters {
+			if len(members[i]) > 0 {
+				setCentroid(&clusters[i], members[i])
+			}
+		}
+	}
+
+	for i := range vecs {
+		c := closestCluster(clusters, &vecs[i])
+		clusters[c].vecs = append(clusters[c].vecs, vecs[i])
+	}
+
+	// drop empty clusters so they don't take up a probe
+	out := clusters[:0]
+	for _, c := range clusters {
+		if len(c.vecs) > 0 {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func setCentroid(c *vecCluster, members []indexedVec) {
+	for i := range c.centroid {
+		c.centroid[i] = 0
+	}
+	for _, v := range members {
+		for i, dim := range v.dims {
+			c.centroid[dim] += v.vals[i]
+		}
+	}
+	c.norm = 0
+	for i := range c.centroid {
+		c.centroid[i] /= float32(len(members))
+		c.norm += float64(c.centroid[i]) * float64(c.centroid[i])
+	}
+}
+
+func closestCluster(clusters []vecCluster, v *indexedVec) int {
+	best, bestDist := 0, math.Inf(1)
+	for i := range clusters {
+		if d := v.dist2(clusters[i].centroid, clusters[i].norm); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+// Search returns the closest compvecs to comp within the query's loop window
+// Results are ordered the same way as Store.SimilarGamePoints. Compvecs newer
+// than kinds are excluded, just like similarVecPoints.
+func (idx *VectorIndex) Search(kinds *KindRegistry, q *SimilarQuery, comp Composition) ([]SimilarGamePoint, error) {
+	idx.mu.RLock()
+	if !idx.ready {
+		idx.mu.RUnlock()
+		return nil, fmt.Errorf("vector index is still loading")
+	}
+	minLoop, maxLoop := q.LoopID-(q.Lag*2), q.LoopID+(q.Lag*2)
+	if minLoop < 0 {
+		minLoop = 0
+	}
+	partitions := make([]*vecPartition, 0)
+	for bucket := minLoop / idx.config.BucketLoops; bucket <= maxLoop/idx.config.BucketLoops; bucket++ {
+		if p, ok := idx.partitions[vecPartitionKey{q.Race, q.OpponentRace, bucket}]; ok {
+			partitions = append(partitions, p)
+		}
+	}
+	nprobe := idx.config.NProbe
+	idx.mu.RUnlock()
+
+	vec := kinds.Vector(comp)
+	weights := kinds.WeightVector(q.Weights)
+	var norm float64
+	for i, v := range vec {
+		w := 1.0
+		if weights != nil {
+			w = float64(weights[i])
+		}
+		norm += w * float64(v) * float64(v)
+	}
+
+	points := make([]SimilarGamePoint, 0)
+	for _, p := range partitions {
+		for _, c := range probeClusters(p, q.Metric, vec, weights, nprobe) {
+			for i := range c.vecs {
+				v := &c.vecs[i]
+				if v.gameID == q.GameID || v.loopID < minLoop || v.loopID > maxLoop || v.version > kinds.Version() {
+					continue
+				}
+				points = append(points, SimilarGamePoint{
+					GameID:   strconv.FormatInt(v.gameID, 10),
+					PlayerID: v.playerID,
+					LoopID:   v.loopID,
+					Dist:     v.distance(q.Metric, vec, weights, norm),
+				})
+			}
+		}
+	}
+
+	return sortSimilarPoints(points, q.LoopID, q.Limit), nil
+}
+
+// probeClusters returns the nprobe clusters whose centroids are closest to vec
+func probeClusters(p *vecPartition, metric string, vec []float32, weights []float32, nprobe int) []*vecCluster {
+	if len(p.clusters) <= nprobe {
+		out := make([]*vecCluster, len(p.clusters))
+		for i := range p.clusters {
+			out[i] = &p.clusters[i]
+		}
+		return out
+	}
+
+	dists := make([]float64, len(p.clusters))
+	order := make([]int, len(p.clusters))
+	for i := range p.clusters {
+		order[i] = i
+		dists[i] = Distance(metric, p.clusters[i].centroid, vec, weights)
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return dists[order[a]] < dists[order[b]]
+	})
+
+	out := make([]*vecCluster, nprobe)
+	for i := range out {
+		out[i] = &p.clusters[order[i]]
+	}
+	return out
+}
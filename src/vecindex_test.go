@@ -0,0 +1,315 @@
+package src
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// vecIndexTestStore serves a fixed set of compvecs to VectorIndex.Refresh
+// Games in loaded are listed even if they have no compvecs.
+type vecIndexTestStore struct {
+	Store
+	loaded   []int64
+	compvecs []Compvec
+}
+
+func (s *vecIndexTestStore) ListLoadedGames() ([]LoadedGame, error) {
+	counts := make(map[int64]int64)
+	out := make([]LoadedGame, 0)
+	for _, gameID := range s.loaded {
+		counts[gameID] = 0
+		out = append(out, LoadedGame{GameID: gameID})
+	}
+	for _, cv := range s.compvecs {
+		if _, ok := counts[cv.GameID]; !ok {
+			out = append(out, LoadedGame{GameID: cv.GameID})
+		}
+		counts[cv.GameID]++
+	}
+	for i := range out {
+		out[i].Compvecs = counts[out[i].GameID]
+	}
+	return out, nil
+}
+
+func (s *vecIndexTestStore) LoadCompvecs(gameIDs []int64) ([]Compvec, error) {
+	want := make(map[int64]bool, len(gameIDs))
+	for _, gameID := range gameIDs {
+		want[gameID] = true
+	}
+	out := make([]Compvec, 0)
+	for _, cv := range s.compvecs {
+		if want[cv.GameID] {
+			out = append(out, cv)
+		}
+	}
+	return out, nil
+}
+
+func testKinds(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = fmt.Sprintf("Kind%02d", i)
+	}
+	return out
+}
+
+// randomCompvecs returns sparse compvecs with fractional values, so that no
+// two points are the same distance from a query
+// Every tenth vector was computed with an older, shorter registry.
+func randomCompvecs(rng *rand.Rand, n int, dims int) []Compvec {
+	out := make([]Compvec, n)
+	for i := range out {
+		version := dims
+		if i%10 == 0 {
+			version = dims - 4
+		}
+		vec := make([]float32, version)
+		for d := range vec {
+			if rng.Intn(3) == 0 {
+				vec[d] = rng.Float32() * 10
+			}
+		}
+		out[i] = Compvec{
+			GameID:       int64(i/20 + 1),
+			PlayerID:     i%2 + 1,
+			Race:         "Zerg",
+			OpponentRace: "Protoss",
+			LoopID:       int64(rng.Intn(2400)),
+			Version:      int64(version),
+			Vec:          vec,
+		}
+	}
+	return out
+}
+
+// bruteForceSimilar is the exact answer VectorIndex.Search approximates
+func bruteForceSimilar(compvecs []Compvec, kinds *KindRegistry, q *SimilarQuery, comp Composition) []SimilarGamePoint {
+	vec := kinds.Vector(comp)
+	weights := kinds.WeightVector(q.Weights)
+	minLoop, maxLoop := q.LoopID-(q.Lag*2), q.LoopID+(q.Lag*2)
+
+	points := make([]SimilarGamePoint, 0)
+	for _, cv := range compvecs {
+		if cv.GameID == q.GameID || cv.LoopID < minLoop || cv.LoopID > maxLoop || cv.Version > kinds.Version() {
+			continue
+		}
+		points = append(points, SimilarGamePoint{
+			GameID:   fmt.Sprint(cv.GameID),
+			PlayerID: cv.PlayerID,
+			LoopID:   cv.LoopID,
+			Dist:     Distance(q.Metric, vec, cv.Vec, weights),
+		})
+	}
+	return sortSimilarPoints(points, q.LoopID, q.Limit)
+}
+
+func TestVectorIndexSearchMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	kinds := NewKindRegistry(testKinds(16))
+	compvecs := randomCompvecs(rng, 4000, 16)
+
+	// more probes than any partition has clusters, so the search is exact
+	idx := NewVectorIndex(VectorIndexConfig{Enabled: true, NProbe: 1000})
+	if err := idx.Refresh(&vecIndexTestStore{compvecs: compvecs}); err != nil {
+		t.Fatal(err)
+	}
+	clustered := false
+	for _, p := range idx.partitions {
+		if len(p.clusters) > 1 {
+			clustered = true
+		}
+	}
+	if !clustered {
+		t.Fatal("expected at least one partition to be clustered")
+	}
+
+	comp := Composition{"Kind00": 3, "Kind03": 1, "Kind07": 6, "Kind15": 2}
+	weights := KindWeights{"Kind00": 0.5, "Kind07": 2.5}
+
+	tests := []struct {
+		name    string
+		metric  string
+		weights KindWeights
+		loop    int64
+		lag     int64
+	}{
+		{"euclidean", MetricEuclidean, nil, 1000, 480},
+		{"cosine", MetricCosine, nil, 1000, 480},
+		{"weighted cosine", MetricCosine, weights, 500, 160},
+		{"weighted euclidean", MetricWeightedEuclidean, weights, 1800, 960},
+		{"window starting before the game", MetricEuclidean, nil, 100, 480},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &SimilarQuery{
+				GameID:       1,
+				PlayerID:     1,
+				Race:         "Zerg",
+				OpponentRace: "Protoss",
+				LoopID:       tt.loop,
+				Lag:          tt.lag,
+				Limit:        25,
+				Metric:       tt.metric,
+				Weights:      tt.weights,
+			}
+			expected := bruteForceSimilar(compvecs, kinds, q, comp)
+			found, err := idx.Search(kinds, q, comp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != len(expected) {
+				t.Fatalf("found %d points, expected %d", len(found), len(expected))
+			}
+			if recall := SimilarRecall(expected, found); recall != 1 {
+				t.Errorf("recall is %v, expected 1\nexpected: %v\nfound: %v", recall, expected, found)
+			}
+		})
+	}
+}
+
+func TestVectorIndexSkipsNewerVectors(t *testing.T) {
+	kinds := NewKindRegistry(testKinds(10))
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		// small partitions are scanned, large ones are clustered first
+		{"scanned partition", 10},
+		{"clustered partition", vecIndexMinClusterSize + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(2))
+			compvecs := randomCompvecs(rng, tt.size, 10)
+			// one point per game, since results are grouped by game and player
+			for i := range compvecs {
+				compvecs[i].GameID = int64(i + 10)
+				compvecs[i].LoopID = 960
+			}
+
+			// computed after two kinds the query's registry doesn't know about
+			// were added, with both of them set
+			newer := make([]float32, 12)
+			newer[0], newer[10], newer[11] = 1, 5, 5
+			compvecs = append(compvecs, Compvec{
+				GameID:       3,
+				PlayerID:     1,
+				Race:         "Zerg",
+				OpponentRace: "Protoss",
+				LoopID:       960,
+				Version:      12,
+				Vec:          newer,
+			})
+
+			idx := NewVectorIndex(VectorIndexConfig{Enabled: true, NProbe: 1000})
+			if err := idx.Refresh(&vecIndexTestStore{compvecs: compvecs}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, metric := range []string{MetricEuclidean, MetricCosine, MetricWeightedEuclidean} {
+				var weights KindWeights
+				if metric == MetricWeightedEuclidean {
+					weights = KindWeights{"Kind00": 2}
+				}
+				q := &SimilarQuery{
+					GameID:       1,
+					PlayerID:     1,
+					Race:         "Zerg",
+					OpponentRace: "Protoss",
+					LoopID:       960,
+					Lag:          480,
+					Limit:        len(compvecs),
+					Metric:       metric,
+					Weights:      weights,
+				}
+				found, err := idx.Search(kinds, q, Composition{"Kind00": 1})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range found {
+					if p.GameID == "3" {
+						t.Errorf("%s: returned a vector newer than the registry: %v", metric, p)
+					}
+				}
+				if len(found) != len(compvecs)-1 {
+					t.Errorf("%s: found %d points, expected %d", metric, len(found), len(compvecs)-1)
+				}
+			}
+		})
+	}
+}
+
+func TestVectorIndexReloadsGamesWhenCompvecsChange(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	kinds := NewKindRegistry(testKinds(10))
+	compvecs := randomCompvecs(rng, 40, 10)
+	for i := range compvecs {
+		compvecs[i].GameID = int64(i + 10)
+		compvecs[i].LoopID = 960
+	}
+
+	// published with -skip-postprocess, so game 3 has no compvecs yet
+	store := &vecIndexTestStore{loaded: []int64{3}, compvecs: compvecs}
+	idx := NewVectorIndex(VectorIndexConfig{Enabled: true})
+	if err := idx.Refresh(store); err != nil {
+		t.Fatal(err)
+	}
+	if games, vecs := idx.Size(); games != 41 || vecs != 40 {
+		t.Fatalf("index has %d games and %d vectors, expected 41 and 40", games, vecs)
+	}
+
+	search := func() []SimilarGamePoint {
+		q := &SimilarQuery{
+			GameID:       1,
+			PlayerID:     1,
+			Race:         "Zerg",
+			OpponentRace: "Protoss",
+			LoopID:       960,
+			Lag:          480,
+			Limit:        100,
+			Metric:       MetricEuclidean,
+		}
+		found, err := idx.Search(kinds, q, Composition{"Kind00": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	tests := []struct {
+		name     string
+		compvecs []Compvec
+		expected int
+	}{
+		{"postprocess computed the game's compvecs", compvecs[:2], 2},
+		{"postprocess recomputed them", compvecs[:3], 3},
+		{"the count is unchanged", compvecs[:3], 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.compvecs = compvecs
+			for _, cv := range tt.compvecs {
+				cv.GameID = 3
+				store.compvecs = append(store.compvecs, cv)
+			}
+			if err := idx.Refresh(store); err != nil {
+				t.Fatal(err)
+			}
+			if games, vecs := idx.Size(); games != 41 || vecs != 40+tt.expected {
+				t.Errorf("index has %d games and %d vectors, expected 41 and %d", games, vecs, 40+tt.expected)
+			}
+			returned := false
+			for _, p := range search() {
+				if p.GameID == "3" {
+					returned = true
+				}
+			}
+			if !returned {
+				t.Errorf("game 3 wasn't returned by a search")
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package src
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IsReplayFile returns true if path looks like a SC2 replay we should process
+func IsReplayFile(path string) bool {
+	basename := filepath.Base(path)
+	return strings.HasSuffix(basename, ".SC2Replay") && !strings.HasPrefix(basename, ".")
+}
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// ReplayWatcher polls a directory tree for new replay files
+// A replay is only reported once its size has stopped changing and it has not
+// been modified for at least Settle. This prevents us from parsing a replay
+// which is still being written by the game client or copied over the network.
+type ReplayWatcher struct {
+	Dir      string
+	Interval time.Duration
+	Settle   time.Duration
+
+	pending map[string]watchedFile
+	done    map[string]bool
+}
+
+func NewReplayWatcher(dir string, interval time.Duration, settle time.Duration) *ReplayWatcher {
+	return &ReplayWatcher{
+		Dir:      dir,
+		Interval: interval,
+		Settle:   settle,
+
+		pending: make(map[string]watchedFile),
+		done:    make(map[string]bool),
+	}
+}
+
+// Scan walks the directory once and returns every replay which has become
+// ready since the last call to Scan
+// Files which are no longer in the directory are forgotten, so that a long
+// running watch only remembers the replays which still exist.
+func (w *ReplayWatcher) Scan(now time.Time) ([]string, error) {
+	ready := make([]string, 0)
+	found := make(map[string]bool, len(w.done)+len(w.pending))
+
+	err := filepath.Walk(w.Dir, func(path string, info os.FileInfo, err error) error {
+		// files come and go while we walk a live folder, so only failing to
+		// read the directory itself is an error
+		if err != nil {
+			if path == w.Dir {
+				return err
+			}
+			log.Printf("skipping %s: %s", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !IsReplayFile(path) {
+			return nil
+		}
+		found[path] = true
+		if w.done[path] {
+			return nil
+		}
+
+		current := watchedFile{size: info.Size(), modTime: info.ModTime()}
+		last, seen := w.pending[path]
+		w.pending[path] = current
+
+		// a file which already existed when we started is ready as soon as it
+		// is old enough; otherwise we also require the size to be stable
+		// between two scans
+		if seen && last.size != current.size {
+			return nil
+		}
+		if current.size == 0 || now.Sub(current.modTime) < w.Settle {
+			return nil
+		}
+
+		delete(w.pending, path)
+		w.done[path] = true
+		ready = append(ready, path)
+		return nil
+	})
+	if err != nil {
+		return ready, err
+	}
+
+	for path := range w.pending {
+		if !found[path] {
+			delete(w.pending, path)
+		}
+	}
+	for path := range w.done {
+		if !found[path] {
+			delete(w.done, path)
+		}
+	}
+	return ready, nil
+}
+
+// Watch scans the directory every Interval and sends ready replays to out
+// until done is closed
+// A failed scan is logged and retried on the next tick.
+func (w *ReplayWatcher) Watch(out chan<- string, done <-chan struct{}) error {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		ready, err := w.Scan(time.Now())
+		if err != nil {
+			log.Printf("unable to scan %s, retrying: %s", w.Dir, err)
+		}
+
+		for _, path := range ready {
+			select {
+			case out <- path:
+			case <-done:
+				return nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -31,12 +31,8 @@ const ReplayCell = ({ k, children }: { k: React.ReactNode; children: React.React
 );
 
 const Replay = ({ replay }: { replay: ReplayMeta }) => {
-    let result = 'Draw';
-    if (replay.p1Result === 'Victory') {
-        result = replay.p1Name;
-    } else if (replay.p2Result === 'Victory') {
-        result = replay.p2Name;
-    }
+    const winners = replay.players.filter((p) => p.result === 'Victory').map((p) => p.name);
+    const result = winners.length > 0 ? winners.join(', ') : 'Draw';
 
     return (
         <Link
@@ -45,12 +41,11 @@ const Replay = ({ replay }: { replay: ReplayMeta }) => {
         >
             <ReplayCell k="map">{replay.mapname}</ReplayCell>
             <ReplayCell k="winner">{result}</ReplayCell>
-            <ReplayCell k={replay.p1Race}>
-                <span className="text-sm">{replay.p1Name}</span>
-            </ReplayCell>
-            <ReplayCell k={replay.p2Race}>
-                <span className="text-sm">{replay.p2Name}</span>
-            </ReplayCell>
+            {replay.players.map((p) => (
+                <ReplayCell k={p.race} key={p.playerid}>
+                    <span className="text-sm">{p.name}</span>
+                </ReplayCell>
+            ))}
             <div className="col-span-2 p-2 break-all text-xs text-gray-300">{replay.filename}</div>
         </Link>
     );
@@ -6,7 +6,7 @@ import { useParams } from 'react-router';
 import { useIntervalWhen } from 'rooks';
 import { LOOPS_PER_SEC } from './const';
 import Header from './Header';
-import { loadTimeline, ReplayEvent, ReplayMeta } from './models';
+import { loadTimeline, playerTimeline, ReplayEvent, ReplayMeta, replayTeams } from './models';
 import { initialState, reduceState, SimilarGame } from './ReplayState';
 import Timeline from './Timeline';
 import { formatSeconds, useFetch } from './util';
@@ -36,7 +36,7 @@ const Replay: React.FC = () => {
 
     useIntervalWhen(() => dispatch( { type: 'tick', maxLoops: replay?.loops || Infinity }), 1000 / LOOPS_PER_SEC, true, true);
 
-    const playerEvents = timeline ? timeline[state.player].events : [];
+    const playerEvents = timeline ? playerTimeline(timeline, state.player).events : [];
     const bisector = d3array.bisector((e: ReplayEvent) => e.loopid);
     const lastEventIdx = bisector.left(playerEvents, state.loop);
 
@@ -104,31 +104,28 @@ const Replay: React.FC = () => {
                     <div className="pr-4 mr-4 border-r-2 border-gray-100">
                         <HeaderCell k="map">{replay.mapname}</HeaderCell>
                     </div>
-                    <HeaderCell
-                        k={replay.p1Race}
-                        className={classNames(
-                            'cursor-pointer border border-transparent rounded px-2 py-0.5 hover:border-indigo-400',
-                            {
-                                'bg-indigo-200': state.player === 1,
-                            }
-                        )}
-                        onClick={() => dispatch({ type: 'select-player', player: 1 })}
-                    >
-                        {replay.p1Name}
-                    </HeaderCell>
-                    <div className="select-none tracking-wider px-4 self-center text-gray-400">vs</div>
-                    <HeaderCell
-                        k={replay.p2Race}
-                        className={classNames(
-                            'cursor-pointer border border-transparent rounded px-2 py-0.5 hover:border-indigo-400',
-                            {
-                                'bg-indigo-200': state.player === 2,
-                            }
-                        )}
-                        onClick={() => dispatch({ type: 'select-player', player: 2 })}
-                    >
-                        {replay.p2Name}
-                    </HeaderCell>
+                    {replayTeams(replay).map((team, i) => (
+                        <React.Fragment key={team[0].teamid}>
+                            {i > 0 && (
+                                <div className="select-none tracking-wider px-4 self-center text-gray-400">vs</div>
+                            )}
+                            {team.map((p) => (
+                                <HeaderCell
+                                    key={p.playerid}
+                                    k={p.race}
+                                    className={classNames(
+                                        'cursor-pointer border border-transparent rounded px-2 py-0.5 hover:border-indigo-400',
+                                        {
+                                            'bg-indigo-200': state.player === p.playerid,
+                                        }
+                                    )}
+                                    onClick={() => dispatch({ type: 'select-player', player: p.playerid })}
+                                >
+                                    {p.name}
+                                </HeaderCell>
+                            ))}
+                        </React.Fragment>
+                    ))}
                 </div>
                 <div className="flex px-10">
                     <div className="self-center mr-2 text-gray-400 h-6 cursor-pointer hover:text-indigo-400">
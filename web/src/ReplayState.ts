@@ -2,13 +2,13 @@ import { LOOPS_PER_SEC } from './const';
 
 export type SimilarGame = {
     gameid: string;
-    playerid: 1 | 2;
+    playerid: number;
     loop: number;
     startLoop: number;
 };
 
 export type Action =
-    | { type: 'select-player'; player: 1 | 2 }
+    | { type: 'select-player'; player: number }
     | { type: 'start' }
     | { type: 'stop' }
     | { type: 'tick'; maxLoops: number }
@@ -19,7 +19,7 @@ export type Action =
 export type State = {
     running: boolean;
     loop: number;
-    player: 1 | 2;
+    player: number;
     similar: SimilarGame[];
 };
 
@@ -5,14 +5,14 @@ import classnames from 'classnames';
 import { scaleSymlog } from 'd3-scale';
 import * as d3array from 'd3-array';
 
-import { loadTimeline, ReplayEvent, ReplayMeta } from './models';
+import { loadTimeline, playerTimeline, ReplayEvent, ReplayMeta, replayPlayer, replayTeams } from './models';
 import { useFetch, formatSeconds, formatSigned } from './util';
 
 import { LOOPS_PER_SEC, LOOPS_PER_MIN } from './const';
 
 type Props = {
     gameID: string;
-    player: 1 | 2;
+    player: number;
     loop: number;
     live?: boolean;
 };
@@ -50,7 +50,7 @@ const Timeline: React.FC<Props> = (props: Props) => {
     if (!state) {
         return null;
     }
-    const { events, stats } = state[props.player];
+    const { events, stats } = playerTimeline(state, props.player);
 
     const loopRadius = LOOPS_PER_MIN * (width > 2000 ? 6 : 2);
     const minLoop = props.loop - loopRadius;
@@ -149,19 +149,29 @@ const Timeline: React.FC<Props> = (props: Props) => {
         .map((tick) => <Tickmark key={tick} tick={tick} left={xAxis(tick)} now={props.loop} />);
 
     const currentStats = d3array.greatest(stats, (s) => (s.loopid > props.loop ? -1 : s.loopid));
-    const supplyIcon = replay ? raceToSupplyIcon[props.player === 1 ? replay.p1Race : replay.p2Race] : 'SupplyDepot';
+    const player = replay && replayPlayer(replay, props.player);
+    const supplyIcon = player ? raceToSupplyIcon[player.race] : 'SupplyDepot';
 
     return (
         <div className="select-none">
             <div className="w-full p-2 flex items-center bg-gray-50 rounded space-x-4 text-sm mb-2">
                 <div className="flex space-x-2 items-center text-sm">
-                    <div className={classnames('rounded-lg px-1 py-0.5 ', { 'bg-indigo-100': props.player === 1 })}>
-                        {replay?.p1Name}
-                    </div>
-                    <div className="text-sm text-gray-400">vs</div>
-                    <div className={classnames('rounded-lg px-1 py-0.5', { 'bg-indigo-100': props.player === 2 })}>
-                        {replay?.p2Name}
-                    </div>
+                    {replay &&
+                        replayTeams(replay).map((team, i) => (
+                            <React.Fragment key={team[0].teamid}>
+                                {i > 0 && <div className="text-sm text-gray-400">vs</div>}
+                                {team.map((p) => (
+                                    <div
+                                        key={p.playerid}
+                                        className={classnames('rounded-lg px-1 py-0.5', {
+                                            'bg-indigo-100': props.player === p.playerid,
+                                        })}
+                                    >
+                                        {p.name}
+                                    </div>
+                                ))}
+                            </React.Fragment>
+                        ))}
                 </div>
                 <div className="flex space-x-2 items-center rounded bg-gray-200 px-1 py-0.5 text-gray-800 text-sm">
                     <img
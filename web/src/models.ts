@@ -2,19 +2,30 @@ import * as d3array from 'd3-array';
 
 type Race = 'Zerg' | 'Protoss' | 'Terran';
 
+export type ReplayPlayer = {
+    playerid: number;
+    teamid: number;
+    name: string;
+    race: Race;
+    result: string;
+};
+
 export type ReplayMeta = {
     gameid: string;
     filename: string;
     mapname: string;
     loops: number;
-    p1Name: string;
-    p1Race: Race;
-    p1Result: string;
-    p2Name: string;
-    p2Race: Race;
-    p2Result: string;
+    matchup: string;
+    players: Array<ReplayPlayer>;
 };
 
+export const replayPlayer = (replay: ReplayMeta, playerid: number): ReplayPlayer | undefined =>
+    replay.players.find((p) => p.playerid === playerid);
+
+// replayTeams groups the players by team, in the order each team first appears
+export const replayTeams = (replay: ReplayMeta): Array<Array<ReplayPlayer>> =>
+    Array.from(d3array.group(replay.players, (p) => p.teamid).values());
+
 export type ReplayEvent = {
     playerid: number;
     loopid: number;
@@ -39,16 +50,19 @@ export type EventsStats = {
     stats: Array<ReplayStats>;
 };
 
-export type Timeline = {
-    1: EventsStats;
-    2: EventsStats;
-};
+export type Timeline = Record<number, EventsStats>;
 
 export const loadTimeline = (data: EventsStats): Timeline => {
     let eventsByPlayer = d3array.group(data.events, (e) => e.playerid);
     let statsByPlayer = d3array.group(data.stats, (e) => e.playerid);
-    return {
-        1: { events: eventsByPlayer.get(1) || [], stats: statsByPlayer.get(1) || [] },
-        2: { events: eventsByPlayer.get(2) || [], stats: statsByPlayer.get(2) || [] },
-    };
+    let timeline: Timeline = {};
+    for (const playerid of new Set([...eventsByPlayer.keys(), ...statsByPlayer.keys()])) {
+        timeline[playerid] = { events: eventsByPlayer.get(playerid) || [], stats: statsByPlayer.get(playerid) || [] };
+    }
+    return timeline;
 };
+
+// playerTimeline returns the events and stats of a player, which are empty if
+// the player never did anything
+export const playerTimeline = (timeline: Timeline, playerid: number): EventsStats =>
+    timeline[playerid] || { events: [], stats: [] };